@@ -2,23 +2,170 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	stdlog "log"
 	"time"
 
 	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/forward"
+	"github.com/henrybarreto/bethrou/client/httpproxy"
+	"github.com/henrybarreto/bethrou/client/pac"
+	"github.com/henrybarreto/bethrou/client/route"
 	socks "github.com/henrybarreto/bethrou/client/socks"
+	"github.com/henrybarreto/bethrou/client/transparent"
 	discovery "github.com/henrybarreto/bethrou/pkg/discovery"
 	host "github.com/henrybarreto/bethrou/pkg/host"
 	"github.com/henrybarreto/bethrou/pkg/logging"
 	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func Connect(ctx context.Context, cfg *config.ClientConfig) error {
+	cli, closeHost, err := start(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	defer closeHost()
+
+	if err := runTunnels(ctx, cli, cfg.Tunnels); err != nil {
+		return err
+	}
+
+	drv, err := socks.NewDriver(cli, cfg.Routing)
+	if err != nil {
+		return fmt.Errorf("invalid routing rules: %w", err)
+	}
+
+	for _, fc := range cfg.Forwards {
+		fw, err := forward.Listen(ctx, drv, fc)
+		if err != nil {
+			return fmt.Errorf("failed to start forward %s: %w", fc.Listen, err)
+		}
+
+		logging.Logger.Info("Forwarding", "listen", fw.Addr(), "target", fc.Target, "node", fc.Node)
+
+		go func() {
+			if err := fw.Serve(); err != nil {
+				logging.Logger.Error("Forward stopped", "listen", fw.Addr(), "error", err)
+			}
+		}()
+	}
+
+	errCh := make(chan error, 4)
+	servers := 0
+
+	// run serves a frontend until it stops, reporting its error on errCh
+	run := func(name string, listenAndServe func() error) {
+		servers++
+
+		go func() {
+			if err := listenAndServe(); err != nil {
+				errCh <- fmt.Errorf("%s error: %w", name, err)
+				return
+			}
+
+			errCh <- nil
+		}()
+	}
+
+	if cfg.Server.ListenAddr != "" {
+		srv, err := socks.NewServer(ctx, drv, cfg.Server)
+		if err != nil {
+			return fmt.Errorf("failed to create SOCKS server: %w", err)
+		}
+
+		logging.Logger.Info("SOCKS5 server running", "addr", cfg.Server.ListenAddr)
+
+		run("SOCKS5 server", srv.ListenAndServe)
+	}
+
+	if cfg.Server.HTTP != nil {
+		srv, err := httpproxy.NewServer(ctx, drv, cfg.Server.HTTP)
+		if err != nil {
+			return fmt.Errorf("failed to create HTTP proxy: %w", err)
+		}
+
+		logging.Logger.Info("HTTP proxy running", "addr", cfg.Server.HTTP.ListenAddr)
+
+		run("HTTP proxy", srv.ListenAndServe)
+	}
+
+	if cfg.Server.Transparent != nil {
+		srv, err := transparent.NewServer(ctx, drv, cfg.Server.Transparent)
+		if err != nil {
+			return fmt.Errorf("failed to create transparent proxy: %w", err)
+		}
+
+		logging.Logger.Info("Transparent proxy running", "addr", cfg.Server.Transparent.ListenAddr, "mode", cfg.Server.Transparent.Mode)
+
+		run("transparent proxy", srv.ListenAndServe)
+	}
+
+	if cfg.PAC != nil {
+		srv := pac.NewServer(ctx, cfg.PAC.ListenAddr, pac.FromConfig(cfg))
+
+		// The proxies keep their listen addresses until restarted, so only the
+		// bypass lists are taken from a changed config.
+		if cfg.Path != "" {
+			go watchConfig(ctx, cfg.Path, func(next *config.ClientConfig) {
+				opts := pac.FromConfig(cfg)
+				opts.Bypass = config.BypassConfig{}
+				if next.PAC != nil {
+					opts.Bypass = next.PAC.Bypass
+				}
+
+				srv.Update(opts)
+
+				logging.Logger.Info("PAC file regenerated", "domains", len(opts.Bypass.Domains), "cidrs", len(opts.Bypass.CIDRs))
+			})
+		}
+
+		logging.Logger.Info("PAC server running", "url", "http://"+cfg.PAC.ListenAddr+"/proxy.pac")
+
+		run("PAC server", srv.ListenAndServe)
+	}
+
+	for range servers {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tunnel connects to the exit nodes and keeps the reverse tunnels of cfg open
+// until ctx is done, without serving SOCKS
+func Tunnel(ctx context.Context, cfg *config.ClientConfig) error {
+	if len(cfg.Tunnels) == 0 {
+		return errors.New("no tunnels configured")
+	}
+
+	cli, closeHost, err := start(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	defer closeHost()
+
+	if err := runTunnels(ctx, cli, cfg.Tunnels); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	return nil
+}
+
+// start validates cfg, creates the host and connects to the exit nodes. The
+// returned function closes the host.
+func start(ctx context.Context, cfg *config.ClientConfig) (*proxy.Client, func(), error) {
 	if err := cfg.Validate(); err != nil {
 		logging.Logger.Error("Configuration validation failed", "error", err)
 
-		return fmt.Errorf("invalid configuration: %w", err)
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	logging.Setup(cfg.Log)
@@ -28,20 +175,38 @@ func Connect(ctx context.Context, cfg *config.ClientConfig) error {
 
 	hst, err := host.NewClient(cfg.Key)
 	if err != nil {
-		return fmt.Errorf("failed to create host: %w", err)
+		return nil, nil, fmt.Errorf("failed to create host: %w", err)
 	}
 
-	defer func() {
+	closeHost := func() {
 		if err := hst.Close(); err != nil {
 			logging.Logger.Error("Error closing host", "error", err)
 		}
-	}()
+	}
 
 	logging.Logger.Info("Client host created", "id", hst.ID())
 
-	pol := proxy.NewPool(proxy.PoolStrategy(cfg.Routing.Strategy))
+	strategy, _ := route.PoolStrategy(cfg.Routing.Strategy)
+	pol := proxy.NewPool(strategy)
+	pol.SetBreaker(cfg.Routing.Breaker.Proxy())
 
 	cli := proxy.NewClient(hst.Host(), pol)
+	cli.Attempts = cfg.Routing.Attempts
+	cli.Hops = cfg.Routing.Hops
+
+	for _, id := range cfg.Routing.Path {
+		pid, err := peer.Decode(id)
+		if err != nil {
+			closeHost()
+			return nil, nil, fmt.Errorf("invalid routing.path node %q: %w", id, err)
+		}
+
+		cli.Path = append(cli.Path, pid)
+	}
+
+	if cli.Hops > 1 || len(cli.Path) > 0 {
+		logging.Logger.Info("TCP connections go through circuits; UDP and DNS lookups still use a single node", "hops", cli.Hops, "path", cfg.Routing.Path)
+	}
 
 	var nodes []config.NodeConfig
 
@@ -50,10 +215,20 @@ func Connect(ctx context.Context, cfg *config.ClientConfig) error {
 		logging.Logger.Info("Loaded static nodes from config", "count", len(cfg.Nodes))
 	}
 
+	var svc *discovery.Service
+
 	if cfg.Discovery.Enabled {
-		dnodes, err := discover(ctx, cfg.Discovery)
+		svc, err = newDiscovery(cfg.Discovery)
+		if err != nil {
+			closeHost()
+			return nil, nil, fmt.Errorf("discovery failed: %w", err)
+		}
+
+		dnodes, err := discover(ctx, svc, cfg.Discovery)
 		if err != nil {
-			return fmt.Errorf("discovery failed: %w", err)
+			_ = svc.Close()
+			closeHost()
+			return nil, nil, fmt.Errorf("discovery failed: %w", err)
 		}
 
 		if len(nodes) == 0 {
@@ -82,11 +257,20 @@ func Connect(ctx context.Context, cfg *config.ClientConfig) error {
 
 	logging.Logger.Info("Connecting to exit nodes")
 	if err := cli.Connect(ctx, nodes); err != nil {
-		return fmt.Errorf("failed to connect to exit nodes: %w", err)
+		if svc != nil {
+			_ = svc.Close()
+		}
+
+		closeHost()
+		return nil, nil, fmt.Errorf("failed to connect to exit nodes: %w", err)
 	}
 
 	logging.Logger.Info("Connected to exit nodes", "count", pol.Size())
 
+	if svc != nil {
+		go newMembership(cli, svc, cfg).run(ctx)
+	}
+
 	if cfg.Routing.Health != "" {
 		healthDur, err := time.ParseDuration(cfg.Routing.Health)
 		if err == nil && healthDur > 0 {
@@ -106,25 +290,7 @@ func Connect(ctx context.Context, cfg *config.ClientConfig) error {
 				for {
 					select {
 					case <-ticker.C:
-						conns := pol.All()
-						for _, c := range conns {
-							logging.Logger.Debug("Pinging node", "peer", c.PeerID, "addr", c.Addr)
-
-							ctxProbe, cancel := context.WithTimeout(context.Background(), timeoutDur+5*time.Second)
-							lat, err := cli.Ping(ctxProbe, c)
-							cancel()
-							if err != nil {
-								logging.Logger.Warn("Health check failed", "peer", c.PeerID, "error", err)
-
-								pol.UpdateLatency(c.PeerID, time.Hour)
-
-								continue
-							}
-
-							logging.Logger.Debug("Node healthy", "peer", c.PeerID, "latency", lat)
-
-							pol.UpdateLatency(c.PeerID, lat)
-						}
+						cli.Probe(ctx, timeoutDur+5*time.Second)
 					case <-ctx.Done():
 						return
 					}
@@ -133,54 +299,5 @@ func Connect(ctx context.Context, cfg *config.ClientConfig) error {
 		}
 	}
 
-	srv, err := socks.NewServer(ctx, cli, cfg.Server)
-	if err != nil {
-		return fmt.Errorf("failed to create SOCKS server: %w", err)
-	}
-
-	logging.Logger.Info("SOCKS5 server running", "addr", cfg.Server.ListenAddr)
-
-	if err := srv.ListenAndServe(); err != nil {
-		return fmt.Errorf("SOCKS5 server error: %w", err)
-	}
-
-	return nil
-}
-
-// disocver uses the discovery service to find nodes.
-func discover(ctx context.Context, cfg *config.DiscoveryConfig) ([]config.NodeConfig, error) {
-	if cfg.Topic == "" {
-		return nil, fmt.Errorf("discovery topic is required")
-	}
-
-	timeout, err := time.ParseDuration(cfg.Timeout)
-	if err != nil {
-		timeout = 10 * time.Second
-	}
-
-	svc, err := discovery.NewService(discovery.Config{
-		Address: cfg.Address,
-		Topic:   cfg.Topic,
-		Timeout: timeout,
-		User:    cfg.User,
-		Pass:    cfg.Pass,
-	}, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	defer func() { _ = svc.Close() }()
-
-	logging.Logger.Info("Running discovery", "topic", cfg.Topic, "timeout", timeout)
-
-	nodes, err := svc.Discover(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(nodes) == 0 {
-		return nil, fmt.Errorf("discovery returned no nodes")
-	}
-
-	return nodes, nil
+	return cli, closeHost, nil
 }
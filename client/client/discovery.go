@@ -0,0 +1,286 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	discovery "github.com/henrybarreto/bethrou/pkg/discovery"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// discoveryInterval is how often discovery is repeated when the config
+	// sets no interval
+	discoveryInterval = time.Minute
+	// discoveryRounds is how many rounds in a row a node may miss before it
+	// is removed, when the config sets none
+	discoveryRounds = 3
+	// joinTimeout bounds connecting to a node found while running
+	joinTimeout = 30 * time.Second
+)
+
+// newDiscovery creates a discovery service in client mode
+func newDiscovery(cfg *config.DiscoveryConfig) (*discovery.Service, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("discovery topic is required")
+	}
+
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		timeout = 10 * time.Second
+	}
+
+	return discovery.NewService(discovery.Config{
+		Address: cfg.Address,
+		Topic:   cfg.Topic,
+		Timeout: timeout,
+		User:    cfg.User,
+		Pass:    cfg.Pass,
+	}, nil)
+}
+
+// discover runs one discovery round and fails when no node answers
+func discover(ctx context.Context, svc *discovery.Service, cfg *config.DiscoveryConfig) ([]config.NodeConfig, error) {
+	logging.Logger.Info("Running discovery", "topic", cfg.Topic)
+
+	nodes, err := svc.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("discovery returned no nodes")
+	}
+
+	return nodes, nil
+}
+
+// membership keeps the pool in sync with discovery while the client runs.
+// Nodes answering a round or announcing a join are connected and added;
+// nodes announcing a leave, or missing several rounds in a row, are removed.
+// Static nodes from the config are never removed, not even when they announce
+// leaving: the config is the operator's statement that they should be used,
+// and a static node that is really down is ejected by its circuit breaker
+// instead.
+//
+// The pool diff is worked out under m.mu, but nodes are connected outside it
+// and concurrently, so a slow or dead node delays neither other joins nor
+// announcements.
+type membership struct {
+	cli      *proxy.Client
+	svc      *discovery.Service
+	static   map[peer.ID]bool
+	interval time.Duration
+	rounds   int
+
+	mu      sync.Mutex
+	missed  map[peer.ID]int
+	joining map[peer.ID]*joining
+}
+
+// joining is a connection to a new node in progress
+type joining struct {
+	cancel context.CancelFunc
+	// left is set when the node leaves before the connection is done
+	left bool
+}
+
+func newMembership(cli *proxy.Client, svc *discovery.Service, cfg *config.ClientConfig) *membership {
+	m := &membership{
+		cli:      cli,
+		svc:      svc,
+		static:   make(map[peer.ID]bool, len(cfg.Nodes)),
+		interval: discoveryInterval,
+		rounds:   discoveryRounds,
+		missed:   make(map[peer.ID]int),
+		joining:  make(map[peer.ID]*joining),
+	}
+
+	for _, n := range cfg.Nodes {
+		if id, err := peer.Decode(n.ID); err == nil {
+			m.static[id] = true
+		}
+	}
+
+	if d, err := time.ParseDuration(cfg.Discovery.Interval); err == nil && d > 0 {
+		m.interval = d
+	}
+
+	if cfg.Discovery.Rounds > 0 {
+		m.rounds = cfg.Discovery.Rounds
+	}
+
+	return m
+}
+
+// run repeats discovery and follows announcements until ctx ends, then
+// closes the service
+func (m *membership) run(ctx context.Context) {
+	defer func() { _ = m.svc.Close() }()
+
+	go func() {
+		err := m.svc.Watch(ctx, func(ev discovery.Event) {
+			m.announced(ctx, ev)
+		})
+		if err != nil && ctx.Err() == nil {
+			logging.Logger.Error("Discovery announcements stopped", "error", err)
+		}
+	}()
+
+	logging.Logger.Info("Keeping exit nodes in sync with discovery", "interval", m.interval, "rounds", m.rounds)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.round(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// round runs one discovery round. A round that fails counts against no node.
+func (m *membership) round(ctx context.Context) {
+	nodes, err := m.svc.Discover(ctx)
+	if err != nil {
+		logging.Logger.Warn("Discovery round failed", "error", err)
+		return
+	}
+
+	m.mu.Lock()
+
+	seen := make(map[peer.ID]bool, len(nodes))
+	var joins []func()
+	for _, n := range nodes {
+		id, err := peer.Decode(n.ID)
+		if err != nil {
+			logging.Logger.Warn("Ignoring discovered node", "node", n.ID, "error", err)
+			continue
+		}
+
+		seen[id] = true
+		if join := m.join(ctx, id, n, "discovered"); join != nil {
+			joins = append(joins, join)
+		}
+	}
+
+	for _, c := range m.cli.Pool.All() {
+		if seen[c.PeerID] || m.static[c.PeerID] {
+			delete(m.missed, c.PeerID)
+			continue
+		}
+
+		m.missed[c.PeerID]++
+		if m.missed[c.PeerID] >= m.rounds {
+			m.leave(c.PeerID, fmt.Sprintf("missed %d discovery rounds", m.missed[c.PeerID]))
+		}
+	}
+
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, join := range joins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			join()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// announced handles a join or leave announced by a node
+func (m *membership) announced(ctx context.Context, ev discovery.Event) {
+	id, err := peer.Decode(ev.Node.ID)
+	if err != nil {
+		logging.Logger.Warn("Ignoring announced node", "node", ev.Node.ID, "error", err)
+		return
+	}
+
+	m.mu.Lock()
+
+	switch ev.Action {
+	case discovery.ActionJoin:
+		join := m.join(ctx, id, ev.Node, "announced")
+		m.mu.Unlock()
+
+		if join != nil {
+			go join()
+		}
+
+		return
+	case discovery.ActionLeave:
+		if m.static[id] {
+			logging.Logger.Info("Static exit node announced leaving; keeping it", "node", id)
+		} else if j, ok := m.joining[id]; ok {
+			j.left = true
+			j.cancel()
+		} else if m.cli.Pool.Get(id) != nil {
+			m.leave(id, "announced")
+		}
+	}
+
+	m.mu.Unlock()
+}
+
+// join prepares connecting to a node that is neither in the pool nor being
+// connected to. It returns the func that connects, to be run without m.mu, or
+// nil when there is nothing to do. The caller must hold m.mu.
+func (m *membership) join(ctx context.Context, id peer.ID, node config.NodeConfig, reason string) func() {
+	delete(m.missed, id)
+
+	if _, ok := m.joining[id]; ok || m.cli.Pool.Get(id) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, joinTimeout)
+
+	j := &joining{cancel: cancel}
+	m.joining[id] = j
+
+	return func() {
+		defer cancel()
+
+		err := m.cli.Connect(ctx, []config.NodeConfig{node})
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.joining, id)
+
+		if j.left {
+			// The node left while connecting; drop it if it got added anyway
+			if err == nil {
+				m.cli.Pool.Remove(id)
+			}
+
+			logging.Logger.Info("Exit node left before joining", "node", id)
+
+			return
+		}
+
+		if err != nil {
+			logging.Logger.Warn("Failed to connect to new exit node", "node", id, "error", err)
+			return
+		}
+
+		logging.Logger.Info("Exit node joined", "node", id, "reason", reason, "nodes", m.cli.Pool.Size())
+	}
+}
+
+// leave removes a node from the pool. The caller must hold m.mu.
+func (m *membership) leave(id peer.ID, reason string) {
+	delete(m.missed, id)
+	m.cli.Pool.Remove(id)
+
+	logging.Logger.Info("Exit node left", "node", id, "reason", reason, "nodes", m.cli.Pool.Size())
+}
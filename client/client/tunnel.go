@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// tunnelTimeout bounds how long opening a tunnel on a node may take
+	tunnelTimeout = 10 * time.Second
+	// tunnelRetry is how long a lost tunnel waits before it is opened again
+	tunnelRetry = 5 * time.Second
+)
+
+// runTunnels opens the configured reverse tunnels and keeps them open until ctx
+// is done
+func runTunnels(ctx context.Context, cli *proxy.Client, tunnels []config.TunnelConfig) error {
+	nodes := make([]peer.ID, len(tunnels))
+	for i, t := range tunnels {
+		if t.Node == "" {
+			continue
+		}
+
+		id, err := peer.Decode(t.Node)
+		if err != nil {
+			return fmt.Errorf("invalid tunnel node %q: %w", t.Node, err)
+		}
+
+		nodes[i] = id
+	}
+
+	for i, t := range tunnels {
+		go keepTunnel(ctx, cli, nodes[i], t)
+	}
+
+	return nil
+}
+
+// keepTunnel opens a tunnel and opens it again whenever it is lost. It gives up
+// when the node policy refuses the tunnel, as retrying would not change the
+// answer.
+func keepTunnel(ctx context.Context, cli *proxy.Client, node peer.ID, t config.TunnelConfig) {
+	for {
+		tun, err := openTunnel(ctx, cli, node, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			var perr *proxy.Error
+			if errors.As(err, &perr) && perr.Code == proxy.CodeNotAllowed {
+				logging.Logger.Error("Tunnel refused", "listen", t.Listen, "target", t.Target, "error", err)
+				return
+			}
+
+			logging.Logger.Warn("Failed to open tunnel", "listen", t.Listen, "target", t.Target, "error", err)
+		} else {
+			logging.Logger.Info("Tunnel open", "node", tun.PeerID, "addr", tun.Addr, "target", t.Target)
+
+			select {
+			case <-tun.Done():
+				logging.Logger.Warn("Tunnel lost", "node", tun.PeerID, "addr", tun.Addr)
+			case <-ctx.Done():
+				_ = tun.Close()
+				return
+			}
+		}
+
+		select {
+		case <-time.After(tunnelRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func openTunnel(ctx context.Context, cli *proxy.Client, node peer.ID, t config.TunnelConfig) (*proxy.Tunnel, error) {
+	ctx, cancel := context.WithTimeout(ctx, tunnelTimeout)
+	defer cancel()
+
+	if node != "" {
+		return cli.Listen(ctx, node, t.Listen, t.Target)
+	}
+
+	return cli.ListenByStrategy(ctx, t.Listen, t.Target)
+}
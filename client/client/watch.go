@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// watchConfig calls fn with the new config whenever the file at path changes.
+// A config that fails to load or validate is logged and skipped.
+func watchConfig(ctx context.Context, path string, fn func(*config.ClientConfig)) {
+	var last time.Time
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+
+		last = info.ModTime()
+
+		cfg, err := config.Load(path)
+		if err == nil {
+			err = cfg.Validate()
+		}
+
+		if err != nil {
+			logging.Logger.Error("Ignoring changed config", "path", path, "error", err)
+			continue
+		}
+
+		logging.Logger.Info("Config changed", "path", path)
+
+		fn(cfg)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/henrybarreto/bethrou/client/client"
 	"github.com/henrybarreto/bethrou/client/config"
 	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -30,28 +29,32 @@ var connectCmd = &cobra.Command{
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
-		if cmd.Flags().Changed("config") {
-			stdlog.Printf("Using config file: %s", configPath)
-		}
-
-		cfg := &config.ClientConfig{}
-		if _, err := os.Stat(configPath); err == nil {
-			data, err := os.ReadFile(configPath)
-			if err != nil {
-				stdlog.Fatalf("failed to read config file %s: %v", configPath, err)
-			}
-
-			if err := yaml.Unmarshal(data, cfg); err != nil {
-				stdlog.Fatalf("failed to parse config file %s: %v", configPath, err)
-			}
-		}
-
-		if cmd.Flags().Changed("key") {
-			cfg.Key = keyPath
-		}
+		cfg := loadConfig(cmd)
 
 		if err := client.Connect(ctx, cfg); err != nil {
 			stdlog.Fatalf("Client failed: %v", err)
 		}
 	},
 }
+
+// loadConfig reads the client config file, if present, and applies the flags
+// shared by the commands that connect to the network
+func loadConfig(cmd *cobra.Command) *config.ClientConfig {
+	if cmd.Flags().Changed("config") {
+		stdlog.Printf("Using config file: %s", configPath)
+	}
+
+	cfg := &config.ClientConfig{}
+	if _, err := os.Stat(configPath); err == nil {
+		cfg, err = config.Load(configPath)
+		if err != nil {
+			stdlog.Fatalf("%v", err)
+		}
+	}
+
+	if cmd.Flags().Changed("key") {
+		cfg.Key = keyPath
+	}
+
+	return cfg
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	stdlog "log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/transparent"
+	"github.com/spf13/cobra"
+)
+
+var (
+	nftMode    string
+	nftPort    int
+	nftCgroup  string
+	nftNetns   string
+	nftIface   string
+	nftMark    int
+	nftTable   int
+	nftInstall bool
+)
+
+func init() {
+	nftCmd.Flags().StringVar(&configPath, "config", "./client.yaml", "Path to client config file, for the transparent listener port and mode")
+	nftCmd.Flags().StringVar(&nftMode, "mode", "", "Transparent mode: redirect or tproxy (default: from config, or redirect)")
+	nftCmd.Flags().IntVar(&nftPort, "port", 0, "Port of the transparent listener (default: from config)")
+	nftCmd.Flags().StringVar(&nftCgroup, "cgroup", "", "Divert connections made by processes of this cgroup v2 path")
+	nftCmd.Flags().StringVar(&nftNetns, "netns", "", "Divert connections coming from this network namespace through its veth pair")
+	nftCmd.Flags().StringVar(&nftIface, "iface", "", "Divert connections arriving on this interface")
+	nftCmd.Flags().IntVar(&nftMark, "mark", 0x1, "Firewall mark used to route TPROXY traffic")
+	nftCmd.Flags().IntVar(&nftTable, "table", 100, "Routing table used to route TPROXY traffic")
+	nftCmd.Flags().BoolVar(&nftInstall, "install", false, "Install the rules with nft and ip instead of printing them")
+
+	rootCmd.AddCommand(nftCmd)
+}
+
+var nftCmd = &cobra.Command{
+	Use:   "nft",
+	Short: "print or install nftables rules for the transparent proxy",
+	Long: `Print or install the nftables rules that divert the TCP connections of a
+cgroup or network namespace to the transparent listener. Connections to local
+addresses are left alone.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules := transparent.Rules{Mode: nftMode, Port: nftPort, Cgroup: nftCgroup, Iface: nftIface, Mark: nftMark, RouteTable: nftTable}
+
+		cfg := loadConfig(cmd)
+		if cfg.Server != nil && cfg.Server.Transparent != nil {
+			if rules.Mode == "" {
+				rules.Mode = cfg.Server.Transparent.Mode
+			}
+
+			if rules.Port == 0 {
+				if _, port, err := net.SplitHostPort(cfg.Server.Transparent.ListenAddr); err == nil {
+					rules.Port, _ = strconv.Atoi(port)
+				}
+			}
+		}
+
+		if rules.Mode == "" {
+			rules.Mode = config.TransparentRedirect
+		}
+
+		if nftNetns != "" {
+			if rules.Iface != "" {
+				stdlog.Fatalf("--netns and --iface cannot be used together")
+			}
+
+			iface, err := netnsPeer(nftNetns)
+			if err != nil {
+				stdlog.Fatalf("failed to find the veth pair of namespace %s: %v", nftNetns, err)
+			}
+
+			rules.Iface = iface
+		}
+
+		ruleset, err := rules.Ruleset()
+		if err != nil {
+			stdlog.Fatalf("invalid rules: %v", err)
+		}
+
+		if !nftInstall {
+			for _, route := range rules.Routes() {
+				fmt.Printf("# %s\n", strings.Join(route, " "))
+			}
+
+			fmt.Print(ruleset)
+
+			return
+		}
+
+		for _, route := range rules.Routes() {
+			// ip rule add is not idempotent, so an earlier rule is removed first
+			if route[2] == "rule" {
+				del := slices.Clone(route)
+				del[3] = "del"
+				_ = exec.Command(del[0], del[1:]...).Run()
+			}
+
+			if out, err := exec.Command(route[0], route[1:]...).CombinedOutput(); err != nil {
+				stdlog.Fatalf("%s failed: %v: %s", strings.Join(route, " "), err, out)
+			}
+		}
+
+		nft := exec.Command("nft", "-f", "-")
+		nft.Stdin = strings.NewReader(ruleset)
+		nft.Stdout = os.Stdout
+		nft.Stderr = os.Stderr
+
+		if err := nft.Run(); err != nil {
+			stdlog.Fatalf("nft failed: %v", err)
+		}
+
+		stdlog.Printf("Installed table inet %s", transparent.Table)
+	},
+}
+
+var vethPeer = regexp.MustCompile(`^\d+: [^@:]+@if(\d+):`)
+
+// netnsPeer returns the host side of the veth pair of a named network
+// namespace
+func netnsPeer(name string) (string, error) {
+	out, err := exec.Command("ip", "-n", name, "-o", "link", "show").Output()
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		m := vethPeer.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		index, _ := strconv.Atoi(m[1])
+
+		iface, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return "", err
+		}
+
+		return iface.Name, nil
+	}
+
+	return "", fmt.Errorf("no veth interface in namespace %s", name)
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	stdlog "log"
+	"strings"
+
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/spf13/cobra"
+)
+
+var routeUser string
+
+func init() {
+	routeExplainCmd.Flags().StringVar(&configPath, "config", "./client.yaml", "Path to client config file")
+	routeExplainCmd.Flags().StringVar(&routeUser, "user", "", "Proxy username the connection is made as, labels included (e.g. alice+region=eu)")
+
+	routeCmd.AddCommand(routeExplainCmd)
+	rootCmd.AddCommand(routeCmd)
+}
+
+var routeCmd = &cobra.Command{
+	Use:   "route",
+	Short: "inspect the routing rules",
+}
+
+var routeExplainCmd = &cobra.Command{
+	Use:   "explain <host:port>",
+	Short: "show which routing rule a connection matches",
+	Long: `Show which routing rule a connection to host:port matches and what is done
+with it. Nothing is dialed and names are not resolved.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig(cmd)
+
+		var rules []route.Rule
+		var selector proxy.Selector
+		strategy := "random"
+
+		if cfg.Routing != nil {
+			rules = cfg.Routing.Rules
+
+			if cfg.Routing.Strategy != "" {
+				strategy = cfg.Routing.Strategy
+			}
+
+			if cfg.Routing.Selector != "" {
+				sel, err := proxy.ParseSelector(cfg.Routing.Selector)
+				if err != nil {
+					stdlog.Fatalf("invalid routing selector: %v", err)
+				}
+
+				selector = sel
+			}
+		}
+
+		router, err := route.New(rules)
+		if err != nil {
+			stdlog.Fatalf("invalid routing rules: %v", err)
+		}
+
+		user, userSelector, err := route.SplitUser(routeUser)
+		if err != nil {
+			stdlog.Fatalf("%v", err)
+		}
+
+		dst, err := route.ParseDestination(args[0], user)
+		if err != nil {
+			stdlog.Fatalf("invalid address %q: %v", args[0], err)
+		}
+
+		action, n := router.Match(dst)
+		if n == 0 {
+			fmt.Printf("no rule matched; %s goes through the network with the %s strategy\n", args[0], strategy)
+		} else {
+			fmt.Printf("rule %d matched: %s\n", n, describe(rules[n-1]))
+			fmt.Printf("action: %s\n", action)
+		}
+
+		switch action.Kind {
+		case route.Default, route.Group, route.Strategy:
+			if sel := route.Merge(selector, action.Selector, userSelector); len(sel) > 0 {
+				fmt.Printf("exit nodes labeled: %s\n", sel)
+			}
+		}
+	},
+}
+
+// describe renders the matchers of a rule on one line
+func describe(r route.Rule) string {
+	var parts []string
+
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%s", name, strings.Join(values, ",")))
+		}
+	}
+
+	add("domains", r.Domains)
+
+	if r.Regex != "" {
+		parts = append(parts, fmt.Sprintf("regex=%q", r.Regex))
+	}
+
+	add("cidrs", r.CIDRs)
+	add("ports", r.Ports)
+	add("users", r.Users)
+
+	if len(parts) == 0 {
+		return "matches everything"
+	}
+
+	return strings.Join(parts, " ")
+}
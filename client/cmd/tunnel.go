@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	stdlog "log"
+	"os/signal"
+	"syscall"
+
+	"github.com/henrybarreto/bethrou/client/client"
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/spf13/cobra"
+)
+
+var (
+	tunnelRemote string
+	tunnelLocal  string
+	tunnelNode   string
+)
+
+func init() {
+	tunnelCmd.Flags().StringVar(&configPath, "config", "./client.yaml", "Path to client config file")
+	tunnelCmd.Flags().StringVar(&keyPath, "key", "", "Path to network.key file (overrides config)")
+	tunnelCmd.Flags().StringVar(&tunnelRemote, "remote", "", "Address the exit node listens on, such as :8080 (overrides the config tunnels)")
+	tunnelCmd.Flags().StringVar(&tunnelLocal, "local", "", "Address connections are relayed to from this machine, such as 127.0.0.1:3000")
+	tunnelCmd.Flags().StringVar(&tunnelNode, "node", "", "Peer ID of the exit node to listen on (default: picked by the routing strategy)")
+
+	rootCmd.AddCommand(tunnelCmd)
+}
+
+var tunnelCmd = &cobra.Command{
+	Use:   "tunnel",
+	Short: "publish local services on exit nodes through reverse tunnels",
+	Long: `Publish local services on exit nodes through reverse tunnels, without
+running the SOCKS server. Tunnels come from the config file, or from --remote
+and --local for a single one.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		cfg := loadConfig(cmd)
+
+		if tunnelRemote != "" || tunnelLocal != "" {
+			if tunnelRemote == "" || tunnelLocal == "" {
+				stdlog.Fatalf("--remote and --local must be set together")
+			}
+
+			cfg.Tunnels = []config.TunnelConfig{{Node: tunnelNode, Listen: tunnelRemote, Target: tunnelLocal}}
+		}
+
+		if err := client.Tunnel(ctx, cfg); err != nil {
+			stdlog.Fatalf("Tunnel failed: %v", err)
+		}
+	},
+}
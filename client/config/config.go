@@ -3,21 +3,30 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/henrybarreto/bethrou/client/route"
 	"github.com/henrybarreto/bethrou/pkg/config"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"gopkg.in/yaml.v3"
 )
 
 type ServerConfig struct {
-	ListenAddr string `yaml:"listen"`
-	Auth       bool   `yaml:"auth"`
-	User       string `yaml:"user,omitempty"`
-	Pass       string `yaml:"pass,omitempty"`
+	ListenAddr  string             `yaml:"listen,omitempty"`
+	Auth        bool               `yaml:"auth"`
+	User        string             `yaml:"user,omitempty"`
+	Pass        string             `yaml:"pass,omitempty"`
+	HTTP        *HTTPConfig        `yaml:"http,omitempty"`
+	Transparent *TransparentConfig `yaml:"transparent,omitempty"`
 }
 
 func (s *ServerConfig) Validate() error {
-	if s.ListenAddr == "" {
-		return errors.New("SOCKS listen address is required")
+	if s.ListenAddr == "" && s.HTTP == nil && s.Transparent == nil {
+		return errors.New("SOCKS listen address is required unless the HTTP or transparent proxy is enabled")
 	}
 
 	if s.Auth {
@@ -26,23 +35,196 @@ func (s *ServerConfig) Validate() error {
 		}
 	}
 
+	if s.HTTP != nil {
+		if err := s.HTTP.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.Transparent != nil {
+		if err := s.Transparent.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// HTTPConfig enables the HTTP proxy listener, which serves CONNECT tunnels and
+// absolute-URI requests. It runs alongside the SOCKS server, or on its own when
+// the SOCKS listen address is empty.
+type HTTPConfig struct {
+	ListenAddr string `yaml:"listen"`
+	Auth       bool   `yaml:"auth"`
+	User       string `yaml:"user,omitempty"`
+	Pass       string `yaml:"pass,omitempty"`
+}
+
+func (h *HTTPConfig) Validate() error {
+	if h.ListenAddr == "" {
+		return errors.New("HTTP listen address is required")
+	}
+
+	if h.Auth {
+		if h.User == "" || h.Pass == "" {
+			return errors.New("HTTP auth enabled but user or pass is empty")
+		}
+	}
+
+	return nil
+}
+
+const (
+	// DNSRemote resolves names with the exit node's resolver
+	DNSRemote = "remote"
+	// DNSLocal resolves names with the client machine's resolver
+	DNSLocal = "local"
+)
+
+const (
+	// StickyHost keeps each destination host on one node
+	StickyHost = "host"
+	// StickyDomain keeps each registrable domain, such as example.co.uk, on
+	// one node, so a site's subdomains share an exit
+	StickyDomain = "domain"
+	// StickyUser keeps each proxy user on one node. Connections without a
+	// user fall back to the host.
+	StickyUser = "user"
+)
+
 type RoutingConfig struct {
-	Strategy string `yaml:"strategy"`
-	Health   string `yaml:"health"`
-	Timeout  string `yaml:"timeout"`
+	Strategy string   `yaml:"strategy"`
+	Health   string   `yaml:"health"`
+	Timeout  string   `yaml:"timeout"`
+	DNS      string   `yaml:"dns"`
+	Attempts int      `yaml:"attempts"`
+	Hops     int      `yaml:"hops"`
+	Path     []string `yaml:"path,omitempty"`
+	// StickyKey is what the sticky strategy keeps on one node: the
+	// destination host, its registrable domain or the proxy user
+	StickyKey string `yaml:"sticky_key,omitempty"`
+	// Selector restricts connections to nodes with matching labels, such as
+	// "region=eu". Group rules and usernames like "user+region=us" override
+	// it label by label.
+	Selector string `yaml:"selector,omitempty"`
+	// Rules pick how each connection is routed, in order; the first match
+	// wins and connections no rule matches use the strategy
+	Rules []route.Rule `yaml:"rules,omitempty"`
+	// Breaker tunes how failing exit nodes are ejected
+	Breaker *BreakerConfig `yaml:"breaker,omitempty"`
+}
+
+// BreakerConfig tunes the circuit breaker that ejects exit nodes after
+// consecutive failed health checks or dials. Zero values use the defaults.
+type BreakerConfig struct {
+	// Disabled keeps every node selectable however often it fails
+	Disabled bool `yaml:"disabled"`
+	// Failures is how many consecutive failures eject a node
+	Failures int `yaml:"failures"`
+	// Ejection is how long an ejected node is left out before it is tried
+	// again
+	Ejection string `yaml:"ejection"`
+	// MaxEjected is the largest percentage of the nodes ejected at once
+	MaxEjected int `yaml:"max_ejected"`
+}
+
+func (b *BreakerConfig) Validate() error {
+	if b.Failures < 0 {
+		return fmt.Errorf("invalid routing.breaker.failures: %d", b.Failures)
+	}
+
+	if b.Ejection != "" {
+		if d, err := time.ParseDuration(b.Ejection); err != nil || d <= 0 {
+			return fmt.Errorf("invalid routing.breaker.ejection duration: %q", b.Ejection)
+		}
+	}
+
+	if b.MaxEjected < 0 || b.MaxEjected > 100 {
+		return fmt.Errorf("invalid routing.breaker.max_ejected: %d", b.MaxEjected)
+	}
+
+	return nil
+}
+
+// Proxy returns the breaker configuration of the pool
+func (b *BreakerConfig) Proxy() proxy.BreakerConfig {
+	cfg := proxy.DefaultBreaker
+	if b == nil {
+		return cfg
+	}
+
+	if b.Disabled {
+		return proxy.BreakerConfig{}
+	}
+
+	if b.Failures > 0 {
+		cfg.Failures = b.Failures
+	}
+
+	if d, err := time.ParseDuration(b.Ejection); err == nil {
+		cfg.Ejection = d
+	}
+
+	if b.MaxEjected > 0 {
+		cfg.MaxEjected = float64(b.MaxEjected) / 100
+	}
+
+	return cfg
 }
 
 func (s *RoutingConfig) Validate() error {
 	switch s.Strategy {
-	case "", "random", "fastest", "round-robin":
+	case "", "random", "fastest", "round-robin", "sticky", "weighted", "least-connections", "least-bytes":
 
 	default:
 		return fmt.Errorf("unsupported routing strategy: %s", s.Strategy)
 	}
 
+	switch s.StickyKey {
+	case "":
+		s.StickyKey = StickyHost
+	case StickyHost, StickyDomain, StickyUser:
+
+	default:
+		return fmt.Errorf("unsupported routing sticky_key: %s", s.StickyKey)
+	}
+
+	switch s.DNS {
+	case "":
+		s.DNS = DNSRemote
+	case DNSRemote, DNSLocal:
+
+	default:
+		return fmt.Errorf("unsupported routing dns mode: %s", s.DNS)
+	}
+
+	if s.Attempts < 0 {
+		return fmt.Errorf("invalid routing.attempts: %d", s.Attempts)
+	}
+
+	if s.Hops < 0 {
+		return fmt.Errorf("invalid routing.hops: %d", s.Hops)
+	}
+
+	seen := make(map[string]bool, len(s.Path))
+	for _, id := range s.Path {
+		if id == "" || seen[id] {
+			return fmt.Errorf("invalid routing.path: node %q is empty or repeated", id)
+		}
+
+		seen[id] = true
+	}
+
+	if s.Selector != "" {
+		if _, err := proxy.ParseSelector(s.Selector); err != nil {
+			return fmt.Errorf("invalid routing.selector: %w", err)
+		}
+	}
+
+	if _, err := route.New(s.Rules); err != nil {
+		return fmt.Errorf("invalid routing.rules: %w", err)
+	}
+
 	if s.Health != "" {
 		if _, err := time.ParseDuration(s.Health); err != nil {
 			return fmt.Errorf("invalid routing.health duration: %w", err)
@@ -55,6 +237,124 @@ func (s *RoutingConfig) Validate() error {
 		}
 	}
 
+	if s.Breaker != nil {
+		if err := s.Breaker.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TunnelConfig publishes a service reachable from the client on a port of an
+// exit node. Listen is the address the node listens on and Target the address
+// its connections are relayed to. Without Node, the node is picked by the
+// routing strategy.
+type TunnelConfig struct {
+	Node   string `yaml:"node,omitempty"`
+	Listen string `yaml:"listen"`
+	Target string `yaml:"target"`
+}
+
+func (t *TunnelConfig) Validate() error {
+	if _, port, err := net.SplitHostPort(t.Listen); err != nil || port == "" || port == "0" {
+		return fmt.Errorf("invalid tunnel listen address %q: a fixed port is required", t.Listen)
+	}
+
+	if _, _, err := net.SplitHostPort(t.Target); err != nil {
+		return fmt.Errorf("invalid tunnel target %q: %w", t.Target, err)
+	}
+
+	return nil
+}
+
+// ForwardConfig relays every connection accepted on a local address to a fixed
+// destination, for programs that cannot use SOCKS. Without Node, the exit node
+// is picked by the routing strategy.
+type ForwardConfig struct {
+	Listen string `yaml:"listen"`
+	Target string `yaml:"target"`
+	Node   string `yaml:"node,omitempty"`
+}
+
+func (f *ForwardConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return fmt.Errorf("invalid forward listen address %q: %w", f.Listen, err)
+	}
+
+	if _, _, err := net.SplitHostPort(f.Target); err != nil {
+		return fmt.Errorf("invalid forward target %q: %w", f.Target, err)
+	}
+
+	return nil
+}
+
+const (
+	// TransparentRedirect takes connections redirected with REDIRECT and
+	// recovers their destination with SO_ORIGINAL_DST
+	TransparentRedirect = "redirect"
+	// TransparentTProxy takes connections diverted with TPROXY, whose local
+	// address is the original destination
+	TransparentTProxy = "tproxy"
+)
+
+// TransparentConfig enables the Linux transparent proxy listener, which takes
+// connections diverted by nftables or iptables and dials their original
+// destination through the network
+type TransparentConfig struct {
+	ListenAddr string `yaml:"listen"`
+	Mode       string `yaml:"mode"`
+}
+
+func (t *TransparentConfig) Validate() error {
+	if t.ListenAddr == "" {
+		return errors.New("transparent listen address is required")
+	}
+
+	switch t.Mode {
+	case "":
+		t.Mode = TransparentRedirect
+	case TransparentRedirect, TransparentTProxy:
+
+	default:
+		return fmt.Errorf("unsupported transparent mode: %s", t.Mode)
+	}
+
+	return nil
+}
+
+// PACConfig enables the proxy auto-config server. The PAC file points browsers
+// at the SOCKS and HTTP listeners and sends the bypass lists, and the hosts of
+// direct routing rules, direct.
+type PACConfig struct {
+	ListenAddr string       `yaml:"listen"`
+	Bypass     BypassConfig `yaml:"bypass"`
+}
+
+// BypassConfig lists destinations that do not go through the network. A
+// domain also matches its subdomains.
+type BypassConfig struct {
+	Domains []string `yaml:"domains,omitempty"`
+	CIDRs   []string `yaml:"cidrs,omitempty"`
+}
+
+func (p *PACConfig) Validate() error {
+	if p.ListenAddr == "" {
+		return errors.New("PAC listen address is required")
+	}
+
+	for _, d := range p.Bypass.Domains {
+		if strings.Trim(d, "*.") == "" {
+			return fmt.Errorf("invalid bypass domain %q", d)
+		}
+	}
+
+	for _, c := range p.Bypass.CIDRs {
+		if _, err := netip.ParsePrefix(c); err != nil {
+			return fmt.Errorf("invalid bypass CIDR %q: %w", c, err)
+		}
+	}
+
 	return nil
 }
 
@@ -71,6 +371,29 @@ type ClientConfig struct {
 	Nodes     []NodeConfig     `yaml:"nodes"`
 	Discovery *DiscoveryConfig `yaml:"discovery"`
 	Log       *LogConfig       `yaml:"log"`
+	Tunnels   []TunnelConfig   `yaml:"tunnels,omitempty"`
+	Forwards  []ForwardConfig  `yaml:"forwards,omitempty"`
+	PAC       *PACConfig       `yaml:"pac,omitempty"`
+
+	// Path is the file the config was loaded from, if any
+	Path string `yaml:"-"`
+}
+
+// Load reads a client config from a YAML file
+func Load(path string) (*ClientConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	cfg := &ClientConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	cfg.Path = path
+
+	return cfg, nil
 }
 
 func (c *ClientConfig) Validate() error {
@@ -102,6 +425,12 @@ func (c *ClientConfig) Validate() error {
 		return fmt.Errorf("discovery config validation failed: %w", err)
 	}
 
+	for i := range c.Nodes {
+		if err := c.Nodes[i].Validate(); err != nil {
+			return fmt.Errorf("node %d validation failed: %w", i+1, err)
+		}
+	}
+
 	if len(c.Nodes) == 0 && !c.Discovery.Enabled {
 		return errors.New("at least one static node or discovery must be enabled")
 	}
@@ -114,10 +443,32 @@ func (c *ClientConfig) Validate() error {
 		return fmt.Errorf("log config validation failed: %w", err)
 	}
 
+	for i := range c.Tunnels {
+		if err := c.Tunnels[i].Validate(); err != nil {
+			return fmt.Errorf("tunnel %d validation failed: %w", i+1, err)
+		}
+	}
+
+	if c.PAC != nil {
+		if c.Server.ListenAddr == "" && c.Server.HTTP == nil {
+			return errors.New("PAC needs the SOCKS or HTTP proxy enabled")
+		}
+
+		if err := c.PAC.Validate(); err != nil {
+			return fmt.Errorf("pac config validation failed: %w", err)
+		}
+	}
+
+	for i := range c.Forwards {
+		if err := c.Forwards[i].Validate(); err != nil {
+			return fmt.Errorf("forward %d validation failed: %w", i+1, err)
+		}
+	}
+
 	return nil
 }
 
 func (c *ClientConfig) String() string {
-	return fmt.Sprintf("ClientConfig{Key: %s, Server: %+v, Routing: %+v, Discovery: %+v, Nodes: %d, Log: %+v}",
-		c.Key, c.Server, c.Routing, c.Discovery, len(c.Nodes), c.Log)
+	return fmt.Sprintf("ClientConfig{Key: %s, Server: %+v, Routing: %+v, Discovery: %+v, Nodes: %d, Tunnels: %d, Forwards: %d, Log: %+v}",
+		c.Key, c.Server, c.Routing, c.Discovery, len(c.Nodes), len(c.Tunnels), len(c.Forwards), c.Log)
 }
@@ -0,0 +1,99 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/socks"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Forwarder relays the connections of one local listener to its target
+type Forwarder struct {
+	ctx      context.Context
+	driver   *socks.Driver
+	listener net.Listener
+	target   string
+	node     peer.ID
+}
+
+// Listen binds the local address of cfg. Connections are dialed through
+// cfg.Node when set, or through a node picked by the routing strategy.
+func Listen(ctx context.Context, driver *socks.Driver, cfg config.ForwardConfig) (*Forwarder, error) {
+	f := &Forwarder{ctx: ctx, driver: driver, target: cfg.Target}
+
+	if cfg.Node != "" {
+		id, err := peer.Decode(cfg.Node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward node %q: %w", cfg.Node, err)
+		}
+
+		f.node = id
+	}
+
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	f.listener = l
+
+	return f, nil
+}
+
+// Addr returns the local address the forwarder listens on
+func (f *Forwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Serve accepts connections until the context is done
+func (f *Forwarder) Serve() error {
+	go func() {
+		<-f.ctx.Done()
+		_ = f.listener.Close()
+	}()
+
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			logging.Logger.Error("failed to accept connection", "error", err)
+
+			continue
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func (f *Forwarder) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var target net.Conn
+	var err error
+
+	if f.node != "" {
+		target, err = f.driver.DialNode(f.node, f.target)
+	} else {
+		target, err = f.driver.Dial("tcp", f.target)
+	}
+
+	if err != nil {
+		logging.Logger.Error("failed to forward connection", "error", err, "listen", f.Addr(), "target", f.target)
+
+		return
+	}
+
+	defer target.Close()
+
+	logging.Logger.Debug("forwarding connection", "remote", conn.RemoteAddr(), "target", f.target)
+
+	socks.Relay(conn, target)
+}
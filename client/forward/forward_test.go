@@ -0,0 +1,84 @@
+package forward_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/forward"
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/client/socks"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+)
+
+// echo serves one connection that sends back what it reads
+func echo(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	return l.Addr().String()
+}
+
+func TestForwarder_RelaysToTarget(t *testing.T) {
+	logging.Setup(nil)
+
+	driver, err := socks.NewDriver(nil, &config.RoutingConfig{Rules: []route.Rule{{Action: "direct", CIDRs: []string{"127.0.0.0/8"}}}})
+	if err != nil {
+		t.Fatalf("failed to create driver: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := forward.Listen(ctx, driver, config.ForwardConfig{Listen: "127.0.0.1:0", Target: echo(t)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	go func() { _ = f.Serve() }()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("expected the target to echo ping, got %q", buf)
+	}
+}
+
+func TestListen_InvalidNode(t *testing.T) {
+	if _, err := forward.Listen(context.Background(), nil, config.ForwardConfig{Listen: "127.0.0.1:0", Target: "example.com:80", Node: "not-a-peer"}); err == nil {
+		t.Fatal("expected an error for an invalid node")
+	}
+}
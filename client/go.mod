@@ -3,11 +3,12 @@ module github.com/henrybarreto/bethrou/client
 go 1.24.7
 
 require (
-	github.com/ezh0v/socks5 v0.9.3
 	github.com/henrybarreto/bethrou v0.0.0-00010101000000-000000000000
 	github.com/libp2p/go-libp2p v0.42.1
 	github.com/multiformats/go-multiaddr v0.16.0
 	github.com/spf13/cobra v1.10.1
+	golang.org/x/net v0.41.0
+	golang.org/x/sys v0.33.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -99,9 +100,7 @@ require (
 	golang.org/x/crypto v0.39.0 // indirect
 	golang.org/x/exp v0.0.0-20250606033433-dcc06ee1d476 // indirect
 	golang.org/x/mod v0.25.0 // indirect
-	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 	golang.org/x/time v0.12.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
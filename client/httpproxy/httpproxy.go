@@ -0,0 +1,328 @@
+package httpproxy
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/client/socks"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+)
+
+// handshakeTimeout bounds how long a client may take to send its request
+// headers before the connection is dropped.
+const handshakeTimeout = 30 * time.Second
+
+// maxTransports bounds how many per-user connection pools are kept. The least
+// recently used one is dropped, and its idle connections closed, past it.
+const maxTransports = 64
+
+// Server is an HTTP proxy that serves CONNECT tunnels and absolute-URI
+// requests through the Bethrou network
+type Server struct {
+	ctx    context.Context
+	driver *socks.Driver
+	addr   string
+	auth   bool
+	user   string
+	pass   string
+	proxy  *httputil.ReverseProxy
+}
+
+// userKey is the request context key of the authenticated proxy user
+type userKey struct{}
+
+func NewServer(ctx context.Context, driver *socks.Driver, cfg *config.HTTPConfig) (*Server, error) {
+	s := &Server{
+		ctx:    ctx,
+		driver: driver,
+		addr:   cfg.ListenAddr,
+	}
+
+	if cfg.Auth {
+		s.auth = true
+		s.user = cfg.User
+		s.pass = cfg.Pass
+	}
+
+	// Rewrite leaves the request as the client sent it. ReverseProxy already
+	// drops hop-by-hop headers, Proxy-Authorization included, and no
+	// X-Forwarded-For is added.
+	s.proxy = &httputil.ReverseProxy{
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: &userTransport{driver: driver},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logging.Logger.Error("forward request failed", "url", r.URL.Redacted(), "error", err)
+
+			code := statusCode(err)
+			http.Error(w, http.StatusText(code), code)
+		},
+	}
+
+	return s, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           s,
+		ReadHeaderTimeout: handshakeTimeout,
+	}
+
+	go func() {
+		<-s.ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.authenticate(r)
+	if !ok {
+		logging.Logger.Warn("HTTP proxy authentication failed", "remote", r.RemoteAddr)
+
+		w.Header().Set("Proxy-Authenticate", `Basic realm="bethrou"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+
+		return
+	}
+
+	user, err := canonicalUser(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		s.connect(w, r, user)
+		return
+	}
+
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "only CONNECT and absolute-URI requests are proxied", http.StatusBadRequest)
+		return
+	}
+
+	logging.Logger.Info("forward", "method", r.Method, "host", r.URL.Host)
+
+	s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+}
+
+// authenticate checks the Basic credentials in Proxy-Authorization. It
+// returns the username, labels included, which is also taken from the header
+// when authentication is not required. The password is checked against the
+// username without its labels.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	user, pass, ok := parseBasicAuth(r.Header.Get("Proxy-Authorization"))
+	if !s.auth {
+		return user, true
+	}
+
+	if !ok {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(user, "+")
+
+	userOK := subtle.ConstantTimeCompare([]byte(name), []byte(s.user)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.pass)) == 1
+
+	if !userOK || !passOK {
+		return "", false
+	}
+
+	return user, true
+}
+
+// canonicalUser rewrites a username with labels into one form, so equivalent
+// label sets such as "alice+b=2+a=1" and "alice+a=1+b=2" share a connection
+// pool
+func canonicalUser(name string) (string, error) {
+	user, sel, err := route.SplitUser(name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sel) == 0 {
+		return user, nil
+	}
+
+	return user + "+" + strings.ReplaceAll(sel.String(), ",", "+"), nil
+}
+
+func parseBasicAuth(header string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+// connect handles a CONNECT request by relaying the hijacked client
+// connection to the target
+func (s *Server) connect(w http.ResponseWriter, r *http.Request, user string) {
+	address := r.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := s.driver.DialUser(user, "tcp", address)
+	if err != nil {
+		logging.Logger.Error("dial failed", "address", address, "error", err)
+
+		code := statusCode(err)
+		http.Error(w, http.StatusText(code), code)
+
+		return
+	}
+
+	defer target.Close()
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		logging.Logger.Error("failed to hijack connection", "error", err)
+		return
+	}
+
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		logging.Logger.Debug("failed to send reply", "error", err)
+		return
+	}
+
+	logging.Logger.Info("dial", "address", address)
+
+	socks.Relay(&hijackedConn{Conn: conn, r: rw.Reader}, target)
+}
+
+// hijackedConn reads through the server's buffered reader, so bytes the client
+// sent right after its CONNECT request are not lost
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite closes the write side of the underlying TCP connection
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// statusCode maps a dial error to an HTTP status. Refusals by the exit node
+// policy or quota are reported as 403 and timeouts as 504; any other failure
+// to reach the target is a 502. Clients only get the status text; the error
+// names nodes and is only logged.
+func statusCode(err error) int {
+	var perr *proxy.Error
+	if !errors.As(err, &perr) {
+		return http.StatusBadGateway
+	}
+
+	switch perr.Code {
+	case proxy.CodeNotAllowed, proxy.CodeQuotaExceeded:
+		return http.StatusForbidden
+	case proxy.CodeTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// userTransport keeps a connection pool per proxy user, so a connection dialed
+// under one user's routing rules is never reused for another. Users are keyed
+// by their canonical name and at most maxTransports pools are kept.
+type userTransport struct {
+	driver *socks.Driver
+
+	mu         sync.Mutex
+	transports map[string]*list.Element
+	lru        list.List
+}
+
+// userPool is an entry of the userTransport LRU list
+type userPool struct {
+	user string
+	tr   *http.Transport
+}
+
+func (t *userTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	user, _ := r.Context().Value(userKey{}).(string)
+
+	return t.transport(user).RoundTrip(r)
+}
+
+func (t *userTransport) transport(user string) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.transports[user]; ok {
+		t.lru.MoveToFront(e)
+		return e.Value.(*userPool).tr
+	}
+
+	tr := &http.Transport{
+		DialContext: func(_ context.Context, network string, addr string) (net.Conn, error) {
+			return t.driver.DialUser(user, network, addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if t.transports == nil {
+		t.transports = make(map[string]*list.Element)
+	}
+
+	t.transports[user] = t.lru.PushFront(&userPool{user: user, tr: tr})
+
+	if t.lru.Len() > maxTransports {
+		oldest := t.lru.Remove(t.lru.Back()).(*userPool)
+		delete(t.transports, oldest.user)
+
+		// Requests still running on the pool keep their connections
+		oldest.tr.CloseIdleConnections()
+	}
+
+	return tr
+}
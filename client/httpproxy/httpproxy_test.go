@@ -0,0 +1,62 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func basic(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	cases := []struct {
+		header string
+		user   string
+		pass   string
+		ok     bool
+	}{
+		{header: "Basic " + basic("alice:secret"), user: "alice", pass: "secret", ok: true},
+		{header: "basic " + basic("alice:secret"), user: "alice", pass: "secret", ok: true},
+		{header: "Basic " + basic("alice:se:cret"), user: "alice", pass: "se:cret", ok: true},
+		{header: "Basic " + basic("alice+region=eu:secret"), user: "alice+region=eu", pass: "secret", ok: true},
+		{header: "Basic " + basic(":"), ok: true},
+		{header: "Basic " + basic("alice")},
+		{header: "Basic not base64!"},
+		{header: "Bearer " + basic("alice:secret")},
+		{header: "Basic"},
+		{header: ""},
+	}
+
+	for _, tc := range cases {
+		user, pass, ok := parseBasicAuth(tc.header)
+		if ok != tc.ok || (ok && (user != tc.user || pass != tc.pass)) {
+			t.Errorf("%q: got %q %q %t, want %q %q %t", tc.header, user, pass, ok, tc.user, tc.pass, tc.ok)
+		}
+	}
+}
+
+func TestCanonicalUser(t *testing.T) {
+	cases := map[string]string{
+		"alice":                   "alice",
+		"alice+region=eu":         "alice+region=eu",
+		"alice+tier=dc+region=eu": "alice+region=eu+tier=dc",
+		"alice+region=eu+tier=dc": "alice+region=eu+tier=dc",
+	}
+
+	for name, want := range cases {
+		got, err := canonicalUser(name)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", name, err)
+			continue
+		}
+
+		if got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := canonicalUser("alice+"); err == nil {
+		t.Error("expected an error for an empty selector")
+	}
+}
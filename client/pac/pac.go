@@ -0,0 +1,201 @@
+package pac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+)
+
+// Options is what a PAC file is generated from. SOCKS and HTTP are the
+// listen addresses of the proxies; either may be empty. The hosts the routing
+// rules always send direct bypass the proxies too, on top of Bypass.
+type Options struct {
+	SOCKS  string
+	HTTP   string
+	Bypass config.BypassConfig
+	Rules  *route.Router
+}
+
+// FromConfig returns the PAC options of a client config
+func FromConfig(cfg *config.ClientConfig) Options {
+	opts := Options{SOCKS: cfg.Server.ListenAddr}
+
+	if cfg.Server.HTTP != nil {
+		opts.HTTP = cfg.Server.HTTP.ListenAddr
+	}
+
+	if cfg.PAC != nil {
+		opts.Bypass = cfg.PAC.Bypass
+	}
+
+	if cfg.Routing != nil {
+		// The config has been validated, so its rules compile
+		opts.Rules, _ = route.New(cfg.Routing.Rules)
+	}
+
+	return opts
+}
+
+// Generate renders the PAC file. A proxy listening on an unspecified address
+// is advertised on host, the address the PAC file was fetched from. Loopback
+// destinations always go direct, and IP ranges only match IP literals so the
+// browser never resolves names locally.
+func Generate(opts Options, host string) string {
+	var proxies []string
+	if opts.SOCKS != "" {
+		proxies = append(proxies, "SOCKS5 "+advertise(opts.SOCKS, host))
+	}
+
+	if opts.HTTP != "" {
+		proxies = append(proxies, "PROXY "+advertise(opts.HTTP, host))
+	}
+
+	directDomains, directPrefixes := opts.Rules.Direct()
+
+	domains := []string{`"localhost"`}
+	for _, d := range opts.Bypass.Domains {
+		domains = append(domains, fmt.Sprintf("%q", strings.ToLower(strings.Trim(d, "*."))))
+	}
+
+	for _, d := range directDomains {
+		domains = append(domains, fmt.Sprintf("%q", d))
+	}
+
+	prefixes := directPrefixes
+	for _, c := range opts.Bypass.CIDRs {
+		if p, err := netip.ParsePrefix(c); err == nil {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	nets4 := []string{`["127.0.0.0", "255.0.0.0"]`}
+	nets6 := []string{`"::1/128"`}
+
+	for _, p := range prefixes {
+		p = p.Masked()
+		if p.Addr().Is4() {
+			mask := net.CIDRMask(p.Bits(), 32)
+			nets4 = append(nets4, fmt.Sprintf("[%q, %q]", p.Addr(), net.IP(mask).String()))
+		} else {
+			nets6 = append(nets6, fmt.Sprintf("%q", p))
+		}
+	}
+
+	var b strings.Builder
+
+	b.WriteString("// Generated by bethrou. Do not edit.\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\thost = host.toLowerCase();\n\n")
+	fmt.Fprintf(&b, "\tvar domains = [%s];\n", strings.Join(domains, ", "))
+	b.WriteString("\tfor (var i = 0; i < domains.length; i++) {\n")
+	b.WriteString("\t\tif (host == domains[i] || dnsDomainIs(host, \".\" + domains[i])) return \"DIRECT\";\n")
+	b.WriteString("\t}\n\n")
+	fmt.Fprintf(&b, "\tvar nets4 = [%s];\n", strings.Join(nets4, ", "))
+	b.WriteString("\tif (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host)) {\n")
+	b.WriteString("\t\tfor (var i = 0; i < nets4.length; i++) {\n")
+	b.WriteString("\t\t\tif (isInNet(host, nets4[i][0], nets4[i][1])) return \"DIRECT\";\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n\n")
+	fmt.Fprintf(&b, "\tvar nets6 = [%s];\n", strings.Join(nets6, ", "))
+	b.WriteString("\tif (host.indexOf(\":\") >= 0 && typeof isInNetEx == \"function\") {\n")
+	b.WriteString("\t\tvar ip = host.replace(/^\\[|\\]$/g, \"\");\n")
+	b.WriteString("\t\tfor (var i = 0; i < nets6.length; i++) {\n")
+	b.WriteString("\t\t\tif (isInNetEx(ip, nets6[i])) return \"DIRECT\";\n")
+	b.WriteString("\t\t}\n")
+	b.WriteString("\t}\n\n")
+	fmt.Fprintf(&b, "\treturn %q;\n", strings.Join(proxies, "; "))
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// advertise returns addr with an unspecified host replaced by host
+func advertise(addr string, host string) string {
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if ip, err := netip.ParseAddr(h); h == "" || (err == nil && ip.IsUnspecified()) {
+		h = host
+	}
+
+	return net.JoinHostPort(h, port)
+}
+
+// Server serves the PAC file at /proxy.pac. Its options can be replaced while
+// it runs.
+type Server struct {
+	ctx  context.Context
+	addr string
+
+	mu   sync.RWMutex
+	opts Options
+}
+
+func NewServer(ctx context.Context, addr string, opts Options) *Server {
+	return &Server{ctx: ctx, addr: addr, opts: opts}
+}
+
+// Update replaces the options the PAC file is generated from
+func (s *Server) Update(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.opts = opts
+}
+
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /proxy.pac", s.serve)
+	mux.HandleFunc("GET /wpad.dat", s.serve)
+
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-s.ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	s.mu.RLock()
+	opts := s.opts
+	s.mu.RUnlock()
+
+	logging.Logger.Debug("serving PAC file", "remote", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(Generate(opts, host)))
+}
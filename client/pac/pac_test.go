@@ -0,0 +1,94 @@
+package pac_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/pac"
+	"github.com/henrybarreto/bethrou/client/route"
+)
+
+func TestGenerate(t *testing.T) {
+	cases := map[string]struct {
+		opts    pac.Options
+		host    string
+		want    []string
+		notWant []string
+	}{
+		"unspecified listen address": {
+			opts: pac.Options{SOCKS: "0.0.0.0:1080", HTTP: ":8080"},
+			host: "192.168.1.10",
+			want: []string{`return "SOCKS5 192.168.1.10:1080; PROXY 192.168.1.10:8080";`},
+		},
+		"specified listen address": {
+			opts: pac.Options{SOCKS: "127.0.0.1:1080"},
+			host: "192.168.1.10",
+			want: []string{`return "SOCKS5 127.0.0.1:1080";`},
+		},
+		"ipv6 host": {
+			opts: pac.Options{HTTP: "[::]:8080"},
+			host: "fd00::1",
+			want: []string{`return "PROXY [fd00::1]:8080";`},
+		},
+		"bypass domains": {
+			opts: pac.Options{SOCKS: "127.0.0.1:1080", Bypass: config.BypassConfig{Domains: []string{"*.Corp.Example", "intranet."}}},
+			want: []string{`var domains = ["localhost", "corp.example", "intranet"];`},
+		},
+		"bypass cidrs": {
+			opts: pac.Options{SOCKS: "127.0.0.1:1080", Bypass: config.BypassConfig{CIDRs: []string{"10.1.2.3/8", "fd00::/8", "not-a-cidr"}}},
+			want: []string{
+				`var nets4 = [["127.0.0.0", "255.0.0.0"], ["10.0.0.0", "255.0.0.0"]];`,
+				`var nets6 = ["::1/128", "fd00::/8"];`,
+			},
+			notWant: []string{"not-a-cidr"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			out := pac.Generate(tc.opts, tc.host)
+
+			if !strings.Contains(out, "function FindProxyForURL(url, host) {") {
+				t.Fatalf("missing FindProxyForURL:\n%s", out)
+			}
+
+			for _, s := range tc.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected %s in:\n%s", s, out)
+				}
+			}
+
+			for _, s := range tc.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("unexpected %s in:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerate_DirectRules(t *testing.T) {
+	rules, err := route.New([]route.Rule{
+		{Action: "block", Domains: []string{"ads.corp.example"}},
+		{Action: "group:region=eu", CIDRs: []string{"10.1.0.0/16"}},
+		{Action: "direct", Domains: []string{"corp.example", "*.Intranet."}},
+		{Action: "direct", CIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{Action: "direct", Domains: []string{"lan.example"}, Ports: []string{"443"}},
+		{Action: "direct", Regex: `^printer\.`},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	out := pac.Generate(pac.Options{SOCKS: "127.0.0.1:1080", Rules: rules}, "")
+
+	for _, s := range []string{
+		`var domains = ["localhost", "intranet"];`,
+		`var nets4 = [["127.0.0.0", "255.0.0.0"], ["192.168.0.0", "255.255.0.0"]];`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %s in:\n%s", s, out)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package route
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Kind is what a routing rule does with a matching connection
+type Kind string
+
+const (
+	// Default sends the connection through the network with the routing
+	// strategy. It is the action when no rule matches.
+	Default Kind = ""
+	// Direct dials the destination from this machine, bypassing the network
+	Direct Kind = "direct"
+	// Block refuses the connection
+	Block Kind = "block"
+	// Node sends the connection through a specific exit node
+	Node Kind = "node"
+	// Group sends the connection through a node whose labels match a selector
+	Group Kind = "group"
+	// Strategy sends the connection through a node picked by another strategy
+	Strategy Kind = "strategy"
+)
+
+// Action is a parsed rule action, such as "direct" or "node:<peer id>"
+type Action struct {
+	Kind     Kind
+	Node     peer.ID
+	Selector proxy.Selector
+	Strategy proxy.PoolStrategy
+}
+
+// ParseAction parses the action of a rule
+func ParseAction(s string) (Action, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+
+	switch Kind(kind) {
+	case Direct, Block:
+		if arg != "" {
+			return Action{}, fmt.Errorf("action %q takes no argument", kind)
+		}
+
+		return Action{Kind: Kind(kind)}, nil
+	case Node:
+		id, err := peer.Decode(arg)
+		if err != nil {
+			return Action{}, fmt.Errorf("invalid node in action %q: %w", s, err)
+		}
+
+		return Action{Kind: Node, Node: id}, nil
+	case Group:
+		sel, err := proxy.ParseSelector(arg)
+		if err != nil {
+			return Action{}, fmt.Errorf("invalid group in action %q: %w", s, err)
+		}
+
+		return Action{Kind: Group, Selector: sel}, nil
+	case Strategy:
+		strategy, ok := strategies[arg]
+		if !ok {
+			return Action{}, fmt.Errorf("unsupported strategy in action %q", s)
+		}
+
+		return Action{Kind: Strategy, Strategy: strategy}, nil
+	default:
+		return Action{}, fmt.Errorf("invalid rule action: %q", s)
+	}
+}
+
+// strategies maps the strategy names of the routing config to pool strategies
+var strategies = map[string]proxy.PoolStrategy{
+	"random":            proxy.RandomStrategy,
+	"fastest":           proxy.FastestStrategy,
+	"round-robin":       proxy.RoundRobinStrategy,
+	"sticky":            proxy.StickyStrategy,
+	"weighted":          proxy.WeightedStrategy,
+	"least-connections": proxy.LeastConnectionsStrategy,
+	"least-bytes":       proxy.LeastBytesStrategy,
+}
+
+// PoolStrategy returns the pool strategy for a strategy name of the routing
+// config. The empty name is random.
+func PoolStrategy(name string) (proxy.PoolStrategy, bool) {
+	if name == "" {
+		return proxy.RandomStrategy, true
+	}
+
+	strategy, ok := strategies[name]
+
+	return strategy, ok
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case Default:
+		return "default"
+	case Node:
+		return "node:" + a.Node.String()
+	case Group:
+		return "group:" + a.Selector.String()
+	case Strategy:
+		for name, strategy := range strategies {
+			if strategy == a.Strategy {
+				return "strategy:" + name
+			}
+		}
+
+		return "strategy:" + string(a.Strategy)
+	default:
+		return string(a.Kind)
+	}
+}
+
+// Destination is a connection as requested by a local program. Host is a
+// domain name or an IP literal; User is the proxy username, if any.
+type Destination struct {
+	Host string
+	Port uint16
+	User string
+}
+
+// ParseDestination splits a host:port address into a Destination
+func ParseDestination(address string, user string) (Destination, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Destination{}, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	return Destination{Host: host, Port: uint16(port), User: user}, nil
+}
+
+// SplitUser splits a proxy username into the user and the label selector
+// appended to it, as in "alice+region=eu" or "alice+region=eu+tier=dc".
+// Passwords are checked against the user alone.
+func SplitUser(name string) (string, proxy.Selector, error) {
+	user, labels, found := strings.Cut(name, "+")
+	if !found {
+		return name, nil, nil
+	}
+
+	sel, err := proxy.ParseSelector(strings.ReplaceAll(labels, "+", ","))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid labels in username %q: %w", name, err)
+	}
+
+	return user, sel, nil
+}
+
+// Merge combines selectors into one. A label set in several keeps the value
+// of the last.
+func Merge(sels ...proxy.Selector) proxy.Selector {
+	merged := make(proxy.Selector)
+	for _, sel := range sels {
+		maps.Copy(merged, sel)
+	}
+
+	return merged
+}
+
+// Rule matches connections by domain suffix, regular expression, CIDR, port
+// range and proxy username. Every non-empty matcher must match for the rule
+// to apply. Domains match a name and its subdomains, and the regex is matched
+// against the lowercased host. CIDRs only match IP literals, so names are
+// never resolved to pick a route.
+type Rule struct {
+	Action  string   `yaml:"action"`
+	Domains []string `yaml:"domains,omitempty"`
+	Regex   string   `yaml:"regex,omitempty"`
+	CIDRs   []string `yaml:"cidrs,omitempty"`
+	Ports   []string `yaml:"ports,omitempty"`
+	Users   []string `yaml:"users,omitempty"`
+}
+
+type rule struct {
+	action   Action
+	domains  []string
+	regex    *regexp.Regexp
+	prefixes []netip.Prefix
+	ports    []policy.PortRange
+	users    []string
+}
+
+// compile parses the matchers and action of r
+func (r *Rule) compile() (*rule, error) {
+	action, err := ParseAction(r.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rule{action: action, users: r.Users}
+
+	for _, d := range r.Domains {
+		domain := policy.NormalizeDomain(strings.TrimPrefix(strings.TrimPrefix(d, "*"), "."))
+		if domain == "" {
+			return nil, fmt.Errorf("invalid domain %q", d)
+		}
+
+		c.domains = append(c.domains, domain)
+	}
+
+	if r.Regex != "" {
+		c.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", r.Regex, err)
+		}
+	}
+
+	for _, s := range r.CIDRs {
+		p, err := policy.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+
+		c.prefixes = append(c.prefixes, p)
+	}
+
+	for _, s := range r.Ports {
+		pr, err := policy.ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+
+		c.ports = append(c.ports, pr)
+	}
+
+	return c, nil
+}
+
+// match reports whether the rule applies to d
+func (r *rule) match(d Destination) bool {
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if pr.Contains(d.Port) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.users) > 0 {
+		ok := false
+		for _, u := range r.users {
+			if d.User == u {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	ip, err := netip.ParseAddr(d.Host)
+	isIP := err == nil
+
+	if len(r.domains) > 0 {
+		if isIP {
+			return false
+		}
+
+		host := policy.NormalizeDomain(d.Host)
+
+		ok := false
+		for _, domain := range r.domains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	if r.regex != nil && !r.regex.MatchString(strings.ToLower(d.Host)) {
+		return false
+	}
+
+	if len(r.prefixes) > 0 {
+		if !isIP {
+			return false
+		}
+
+		ip = ip.Unmap()
+
+		ok := false
+		for _, p := range r.prefixes {
+			if p.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Router picks the action for a connection from an ordered rule list. The
+// first matching rule wins.
+type Router struct {
+	rules []*rule
+}
+
+// New compiles rules into a Router
+func New(rules []Rule) (*Router, error) {
+	r := &Router{rules: make([]*rule, 0, len(rules))}
+
+	for i := range rules {
+		c, err := rules[i].compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+
+		r.rules = append(r.rules, c)
+	}
+
+	return r, nil
+}
+
+// Match returns the action for d and the 1-based number of the rule that
+// matched, or zero when none did. A nil Router has no rules.
+func (r *Router) Match(d Destination) (Action, int) {
+	if r == nil {
+		return Action{}, 0
+	}
+
+	for i, rule := range r.rules {
+		if rule.match(d) {
+			return rule.action, i + 1
+		}
+	}
+
+	return Action{}, 0
+}
+
+// Direct returns the domains and IP ranges whose every connection is routed
+// direct, for clients such as browsers reading a PAC file that can only send
+// whole hosts direct. Only direct rules matching on domains and CIDRs alone
+// are used, and their entries are left out when an earlier rule with another
+// action could match the same hosts.
+func (r *Router) Direct() ([]string, []netip.Prefix) {
+	if r == nil {
+		return nil, nil
+	}
+
+	var domains []string
+	var prefixes []netip.Prefix
+
+	for i, c := range r.rules {
+		if c.action.Kind != Direct || c.regex != nil || len(c.ports) > 0 || len(c.users) > 0 {
+			continue
+		}
+
+		earlier := r.rules[:i]
+
+		for _, d := range c.domains {
+			if !slices.ContainsFunc(earlier, func(e *rule) bool { return e.action.Kind != Direct && e.mayMatchDomain(d) }) {
+				domains = append(domains, d)
+			}
+		}
+
+		for _, p := range c.prefixes {
+			if !slices.ContainsFunc(earlier, func(e *rule) bool { return e.action.Kind != Direct && e.mayMatchPrefix(p) }) {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+
+	return domains, prefixes
+}
+
+// mayMatchDomain reports whether the rule could match domain or one of its
+// subdomains. Regexes, ports and users are not looked into.
+func (r *rule) mayMatchDomain(domain string) bool {
+	if len(r.prefixes) > 0 {
+		return false
+	}
+
+	if len(r.domains) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(r.domains, func(d string) bool {
+		return d == domain || strings.HasSuffix(d, "."+domain) || strings.HasSuffix(domain, "."+d)
+	})
+}
+
+// mayMatchPrefix reports whether the rule could match an address of p
+func (r *rule) mayMatchPrefix(p netip.Prefix) bool {
+	if len(r.domains) > 0 {
+		return false
+	}
+
+	if len(r.prefixes) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(r.prefixes, p.Overlaps)
+}
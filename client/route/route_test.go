@@ -0,0 +1,116 @@
+package route_test
+
+import (
+	"testing"
+
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+)
+
+func TestRouter_Match(t *testing.T) {
+	r, err := route.New([]route.Rule{
+		{Action: "block", Domains: []string{"*.ads.example"}},
+		{Action: "direct", CIDRs: []string{"10.0.0.0/8", "fd00::/8"}},
+		{Action: "group:region=eu", Domains: []string{"Example.EU"}, Ports: []string{"443"}},
+		{Action: "strategy:fastest", Regex: `^stream[0-9]+\.`},
+		{Action: "direct", Users: []string{"bob"}, Ports: []string{"8000-8100"}},
+		{Action: "group:region=us", Domains: []string{"example.eu"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		host string
+		port uint16
+		user string
+		want string
+		rule int
+	}{
+		{host: "ads.example", port: 80, want: "block", rule: 1},
+		{host: "tracker.ads.example", port: 443, want: "block", rule: 1},
+		{host: "badads.example", port: 80, want: "default", rule: 0},
+		{host: "10.1.2.3", port: 22, want: "direct", rule: 2},
+		{host: "::ffff:10.1.2.3", port: 22, want: "direct", rule: 2},
+		{host: "fd00::1", port: 22, want: "direct", rule: 2},
+		{host: "11.1.2.3", port: 22, want: "default", rule: 0},
+		{host: "www.example.eu", port: 443, want: "group:region=eu", rule: 3},
+		{host: "WWW.EXAMPLE.EU.", port: 443, want: "group:region=eu", rule: 3},
+		{host: "www.example.eu", port: 80, want: "group:region=us", rule: 6},
+		{host: "Stream7.video.example", port: 443, want: "strategy:fastest", rule: 4},
+		{host: "video.example", port: 8080, user: "bob", want: "direct", rule: 5},
+		{host: "video.example", port: 8080, user: "alice", want: "default", rule: 0},
+		{host: "video.example", port: 9000, user: "bob", want: "default", rule: 0},
+	}
+
+	for _, tc := range cases {
+		action, rule := r.Match(route.Destination{Host: tc.host, Port: tc.port, User: tc.user})
+		if action.String() != tc.want || rule != tc.rule {
+			t.Errorf("%s:%d (%q): got %s (rule %d), want %s (rule %d)", tc.host, tc.port, tc.user, action, rule, tc.want, tc.rule)
+		}
+	}
+}
+
+func TestRouter_MatchNil(t *testing.T) {
+	var r *route.Router
+
+	if action, rule := r.Match(route.Destination{Host: "example.com", Port: 443}); action.Kind != route.Default || rule != 0 {
+		t.Errorf("expected the default action, got %s (rule %d)", action, rule)
+	}
+}
+
+func TestNew_RejectsInvalidRules(t *testing.T) {
+	cases := map[string]route.Rule{
+		"action":   {Action: "tunnel"},
+		"node":     {Action: "node:not-a-peer"},
+		"strategy": {Action: "strategy:slowest"},
+		"argument": {Action: "direct:now"},
+		"domain":   {Action: "direct", Domains: []string{"*."}},
+		"regex":    {Action: "direct", Regex: "("},
+		"cidr":     {Action: "direct", CIDRs: []string{"10.0.0.0/33"}},
+		"port":     {Action: "direct", Ports: []string{"90-80"}},
+	}
+
+	for name, rule := range cases {
+		if _, err := route.New([]route.Rule{rule}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSplitUser(t *testing.T) {
+	cases := []struct {
+		name string
+		user string
+		sel  proxy.Selector
+		err  bool
+	}{
+		{name: "alice", user: "alice"},
+		{name: "", user: ""},
+		{name: "alice+region=eu", user: "alice", sel: proxy.Selector{"region": "eu"}},
+		{name: "alice+region=eu+tier=dc", user: "alice", sel: proxy.Selector{"region": "eu", "tier": "dc"}},
+		{name: "alice+gpu", user: "alice", sel: proxy.Selector{"gpu": ""}},
+		{name: "alice+", err: true},
+		{name: "alice+region=eu+=dc", err: true},
+	}
+
+	for _, tc := range cases {
+		user, sel, err := route.SplitUser(tc.name)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.name, err)
+			continue
+		}
+
+		if user != tc.user || sel.String() != tc.sel.String() {
+			t.Errorf("%q: got %q %q, want %q %q", tc.name, user, sel, tc.user, tc.sel)
+		}
+	}
+}
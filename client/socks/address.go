@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	addressTypeIPv4 byte = 0x01
+	addressTypeFQDN byte = 0x03
+	addressTypeIPv6 byte = 0x04
+)
+
+var errAddressTypeNotSupported = errors.New("address type not supported")
+
+// readAddress reads a SOCKS5 DST.ADDR and DST.PORT pair and returns it as a
+// host:port string.
+func readAddress(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case addressTypeIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+
+		host = net.IP(ip).String()
+	case addressTypeIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+
+		host = net.IP(ip).String()
+	case addressTypeFQDN:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+
+		host = string(domain)
+	default:
+		return "", errAddressTypeNotSupported
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendAddress appends addr in SOCKS5 BND.ADDR and BND.PORT form. Addresses
+// that are not host:port pairs are encoded as 0.0.0.0:0.
+func appendAddress(b []byte, addr string) []byte {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(b, addressTypeIPv4, 0, 0, 0, 0, 0, 0)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		port = 0
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, addressTypeIPv4)
+		} else {
+			b = append(b, addressTypeIPv6)
+		}
+
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+
+		b = append(b, addressTypeFQDN, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
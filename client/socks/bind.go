@@ -0,0 +1,123 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+)
+
+// bindTimeout bounds how long a direct BIND listener waits for its inbound
+// connection, like the exit node does for its own listeners
+const bindTimeout = 2 * time.Minute
+
+// Binding is a listener opened for a SOCKS BIND request, on an exit node or,
+// for destinations routed direct, on this machine
+type Binding interface {
+	// Address is where the expected peer should connect
+	Address() string
+	// Accept waits for the inbound connection and returns it with the address
+	// of its remote end
+	Accept() (net.Conn, string, error)
+	// Close gives up on the inbound connection, or closes it once accepted
+	Close() error
+}
+
+// nodeBinding is a listener opened on an exit node
+type nodeBinding struct {
+	*proxy.Binding
+}
+
+func (b nodeBinding) Address() string {
+	return b.Addr
+}
+
+// directBinding is a listener opened on this machine for an expected peer
+// routed direct. Only connections from the addresses the peer resolves to are
+// accepted.
+type directBinding struct {
+	ln      *net.TCPListener
+	allowed []netip.Addr
+}
+
+// bindDirect listens on the local address this machine uses to reach the
+// expected peer at address
+func (d *Driver) bindDirect(ctx context.Context, address string) (Binding, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	allowed, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ip := range allowed {
+		allowed[i] = ip.Unmap()
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP(allowed[0]).AsSlice()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bind listener: %w", err)
+	}
+
+	_ = ln.SetDeadline(time.Now().Add(bindTimeout))
+
+	return &directBinding{ln: ln, allowed: allowed}, nil
+}
+
+// localIP returns the address this machine would use to reach dst. Connecting
+// a UDP socket only picks the route; no packet is sent.
+func localIP(dst netip.Addr) netip.Addr {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.IPv4Unspecified()
+	}
+
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+}
+
+func (b *directBinding) Address() string {
+	return b.ln.Addr().String()
+}
+
+func (b *directBinding) Accept() (net.Conn, string, error) {
+	defer b.ln.Close()
+
+	for {
+		conn, err := b.ln.AcceptTCP()
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				return nil, "", proxy.NewError(proxy.CodeTimeout, "no inbound connection before the bind timeout")
+			}
+
+			return nil, "", err
+		}
+
+		from := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		for _, a := range b.allowed {
+			if a == from {
+				return conn, conn.RemoteAddr().String(), nil
+			}
+		}
+
+		logging.Logger.Warn("dropping bind connection from unexpected peer", "from", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+func (b *directBinding) Close() error {
+	return b.ln.Close()
+}
@@ -5,22 +5,91 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/ezh0v/socks5"
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/route"
 	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
 	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/net/publicsuffix"
 )
 
-var _ socks5.Driver = (*Driver)(nil)
+// resolveTimeout bounds a single name lookup
+const resolveTimeout = 10 * time.Second
 
+// directTimeout bounds dialing a destination routed direct
+const directTimeout = 10 * time.Second
+
+// Driver opens the outbound side of SOCKS requests through the Bethrou network
 type Driver struct {
-	proxy *proxy.Client
+	proxy     *proxy.Client
+	dns       string
+	stickyKey string
+	selector  proxy.Selector
+	router    *route.Router
+}
+
+// NewDriver creates a driver that dials through p with the routing config
+// cfg: its DNS mode selects where names are resolved, its rules and default
+// selector are applied to every Dial and its sticky key identifies
+// connections for the sticky strategy.
+func NewDriver(p *proxy.Client, cfg *config.RoutingConfig) (*Driver, error) {
+	router, err := route.New(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	var selector proxy.Selector
+	if cfg.Selector != "" {
+		selector, err = proxy.ParseSelector(cfg.Selector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Driver{proxy: p, dns: cfg.DNS, stickyKey: cfg.StickyKey, selector: selector, router: router}
+	if d.dns == "" {
+		d.dns = config.DNSRemote
+	}
+
+	return d, nil
 }
 
 func (d *Driver) Dial(network string, address string) (net.Conn, error) {
+	return d.DialUser("", network, address)
+}
+
+// DialUser dials address on behalf of a proxy user, whose name routing rules
+// may match on. Labels appended to the name, as in "alice+region=eu", select
+// the exit node over the default selector and the matching rule's group.
+func (d *Driver) DialUser(name string, network string, address string) (net.Conn, error) {
 	ctx := context.Background()
 
-	conn, err := d.proxy.DialByStrategy(ctx, address)
+	r, err := d.match(name, address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.action.Kind {
+	case route.Block:
+		return nil, r.blocked()
+	case route.Direct:
+		return d.dialDirect(ctx, network, address)
+	case route.Node:
+		return d.DialNode(r.action.Node, address)
+	}
+
+	address, err = d.resolveAddress(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.proxy.DialRoute(ctx, r.route(d), address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial through any node: %w", err)
 	}
@@ -30,57 +99,290 @@ func (d *Driver) Dial(network string, address string) (net.Conn, error) {
 	return conn, nil
 }
 
-func (d *Driver) Listen(network string, address string) (net.Listener, error) {
-	l, err := net.Listen(network, address)
+// routed is a destination with the routing rule that applies to it
+type routed struct {
+	address string
+	dst     route.Destination
+	action  route.Action
+	rule    int
+	// labels is the selector appended to the username
+	labels proxy.Selector
+}
+
+// match runs the routing rules for address on behalf of a proxy user
+func (d *Driver) match(name string, address string) (*routed, error) {
+	user, labels, err := route.SplitUser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := route.ParseDestination(address, user)
+	if err != nil {
+		return nil, err
+	}
+
+	action, rule := d.router.Match(dst)
+	if rule > 0 {
+		logging.Logger.Debug("routing rule matched", "address", address, "user", user, "rule", rule, "action", action)
+	}
+
+	return &routed{address: address, dst: dst, action: action, rule: rule, labels: labels}, nil
+}
+
+// blocked is the error for a destination a block rule refused
+func (r *routed) blocked() error {
+	return proxy.NewError(proxy.CodeNotAllowed, fmt.Sprintf("%s is blocked by routing rule %d", r.address, r.rule))
+}
+
+// route returns how the network picks a node for a destination that is not
+// blocked, direct or pinned to a node
+func (r *routed) route(d *Driver) proxy.Route {
+	selector := route.Merge(d.selector, r.action.Selector, r.labels)
+
+	return proxy.Route{Strategy: r.action.Strategy, Selector: selector, Key: d.key(r.dst)}
+}
+
+// dialDirect dials address from this machine. The name is still looked up
+// with the configured resolver, so in remote mode it is resolved by an exit
+// node and never reaches the local one.
+func (d *Driver) dialDirect(ctx context.Context, network string, address string) (net.Conn, error) {
+	addr, err := d.Resolve(network, address)
 	if err != nil {
-		logging.Logger.Error("failed to listen", "error", err, "address", address, "network", network)
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: directTimeout}
+
+	conn, err := dialer.DialContext(ctx, network, addr.String())
+	if err != nil {
+		return nil, proxy.NewError(proxy.Classify(err), err.Error())
+	}
+
+	return conn, nil
+}
 
+// DialNode dials address through a specific exit node instead of one picked by
+// the routing strategy
+func (d *Driver) DialNode(node peer.ID, address string) (net.Conn, error) {
+	ctx := context.Background()
+
+	address, err := d.resolveAddress(ctx, address)
+	if err != nil {
 		return nil, err
 	}
 
-	// logging.Logger.Debug("Listening", "address", address, "network", network)
+	conn, err := d.proxy.Dial(ctx, node, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial through node %s: %w", node, err)
+	}
 
-	return l, nil
+	return conn, nil
+}
+
+// Bind asks an exit node to accept one inbound connection from address, the
+// expected peer of a SOCKS BIND request. The listener is opened on the node,
+// not on this machine.
+func (d *Driver) Bind(address string) (Binding, error) {
+	return d.BindUser("", address)
 }
 
-func (d *Driver) ListenPacket(network string, address string) (net.PacketConn, error) {
-	c, err := net.ListenPacket(network, address)
+// BindUser is Bind on behalf of a proxy user. Routing rules apply to the
+// expected peer as they do to a dial: a blocked peer is refused, a direct one
+// gets a listener on this machine and otherwise the node is picked like for
+// DialUser.
+func (d *Driver) BindUser(name string, address string) (Binding, error) {
+	ctx := context.Background()
+
+	r, err := d.match(name, address)
 	if err != nil {
-		logging.Logger.Error("failed to listen packet", "error", err, "address", address, "network", network)
+		return nil, err
+	}
+
+	switch r.action.Kind {
+	case route.Block:
+		return nil, r.blocked()
+	case route.Direct:
+		return d.bindDirect(ctx, address)
+	}
 
+	address, err = d.resolveAddress(ctx, address)
+	if err != nil {
 		return nil, err
 	}
 
-	// logging.Logger.Debug("Listening packet", "address", address, "network", network)
+	var b *proxy.Binding
+	if r.action.Kind == route.Node {
+		b, err = d.proxy.Bind(ctx, r.action.Node, address)
+	} else {
+		b, err = d.proxy.BindRoute(ctx, r.route(d), address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind through any node: %w", err)
+	}
+
+	return nodeBinding{b}, nil
+}
+
+// RoutePacket runs the routing rules for a datagram a proxy user sends to
+// address. It returns the action and the address to write the datagram to on
+// the socket ListenPacketAction opens for that action: the resolved address
+// for direct, or the destination as the exit node should see it.
+// Blocked destinations fail with the same error as a blocked dial.
+func (d *Driver) RoutePacket(name string, address string) (route.Action, net.Addr, error) {
+	ctx := context.Background()
+
+	r, err := d.match(name, address)
+	if err != nil {
+		return route.Action{}, nil, err
+	}
+
+	switch r.action.Kind {
+	case route.Block:
+		return r.action, nil, r.blocked()
+	case route.Direct:
+		addr, err := d.Resolve("udp", address)
+
+		return r.action, addr, err
+	}
+
+	address, err = d.resolveAddress(ctx, address)
+	if err != nil {
+		return r.action, nil, err
+	}
+
+	return r.action, pkgnetwork.DatagramAddr(address), nil
+}
+
+// ListenPacketAction opens the socket datagrams routed by action go through on
+// behalf of a proxy user. Address is the destination that opened it and keys
+// the sticky strategy.
+func (d *Driver) ListenPacketAction(name string, action route.Action, address string) (net.PacketConn, error) {
+	ctx := context.Background()
+
+	switch action.Kind {
+	case route.Block:
+		return nil, errors.New("blocked destinations have no socket")
+	case route.Direct:
+		return net.ListenPacket("udp", ":0")
+	}
+
+	var c net.PacketConn
+	var err error
+
+	if action.Kind == route.Node {
+		c, err = d.proxy.ListenPacket(ctx, action.Node)
+	} else {
+		user, labels, _ := route.SplitUser(name)
+		dst, _ := route.ParseDestination(address, user)
+
+		r := &routed{address: address, dst: dst, action: action, labels: labels}
+
+		c, err = d.proxy.ListenPacketRoute(ctx, r.route(d))
+	}
+
+	if err != nil {
+		logging.Logger.Error("failed to listen packet", "error", err, "action", action)
+
+		return nil, fmt.Errorf("failed to open udp association through any node: %w", err)
+	}
 
 	return c, nil
 }
 
+// Resolve resolves a host:port address. In remote mode the lookup is done by
+// an exit node, so names never reach the local resolver.
 func (d *Driver) Resolve(network string, address string) (net.Addr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		logging.Logger.Error("failed to resolve address", "error", err, "address", address, "network", network, "dns", d.dns)
+
+		return nil, err
+	}
+
+	ap := netip.AddrPortFrom(ips[0].Unmap(), uint16(port))
+
 	switch network {
 	case "udp":
-		a, err := net.ResolveUDPAddr(network, address)
-		if err != nil {
-			logging.Logger.Error("failed to resolve udp address", "error", err, "address", address, "network", network)
+		return net.UDPAddrFromAddrPort(ap), nil
+	case "tcp":
+		return net.TCPAddrFromAddrPort(ap), nil
+	default:
+		return nil, errors.New("unsupported network")
+	}
+}
 
-			return nil, err
+// key returns what the sticky strategy hashes for dst
+func (d *Driver) key(dst route.Destination) string {
+	host := strings.ToLower(strings.TrimSuffix(dst.Host, "."))
+
+	switch d.stickyKey {
+	case config.StickyUser:
+		if dst.User != "" {
+			return "user:" + dst.User
+		}
+	case config.StickyDomain:
+		// IP literals and public suffixes have no registrable domain and
+		// stay keyed on the host
+		if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			return domain
 		}
+	}
+
+	return host
+}
 
-		// logging.Logger.Debug("Resolved udp address", "address", address, "network", network)
+// lookup returns the addresses of host using the configured resolver
+func (d *Driver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
 
-		return a, nil
-	case "tcp":
-		a, err := net.ResolveTCPAddr(network, address)
+	if d.dns == config.DNSLocal {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
 		if err != nil {
-			logging.Logger.Error("failed to resolve tcp address", "error", err, "address", address, "network", network)
-
-			return nil, err
+			return nil, proxy.NewError(proxy.CodeDNSFailure, err.Error())
 		}
 
-		// logging.Logger.Debug("Resolved tcp address", "address", address, "network", network)
+		return ips, nil
+	}
 
-		return a, nil
-	default:
-		return nil, errors.New("unsupported network")
+	return d.proxy.ResolveByStrategy(ctx, host)
+}
+
+// resolveAddress resolves the host of a host:port locally when the driver is
+// in local mode. In remote mode names are passed to the exit node unchanged
+// and resolved there as part of the dial.
+func (d *Driver) resolveAddress(ctx context.Context, address string) (string, error) {
+	if d.dns != config.DNSLocal {
+		return address, nil
 	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
 }
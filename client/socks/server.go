@@ -1,23 +1,32 @@
 package socks
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"net"
+	"strconv"
+	"time"
 
-	"github.com/ezh0v/socks5"
 	"github.com/henrybarreto/bethrou/client/config"
 	"github.com/henrybarreto/bethrou/pkg/logging"
-	"github.com/henrybarreto/bethrou/pkg/proxy"
 )
 
+// handshakeTimeout bounds how long a client may take to negotiate before the
+// connection is dropped.
+const handshakeTimeout = 30 * time.Second
+
 type Server struct {
-	driver   *Driver
-	host     string
-	port     int
-	internal *socks5.Server
+	ctx    context.Context
+	driver *Driver
+	host   string
+	port   int
+	auth   bool
+	user   string
+	pass   string
 }
 
-func NewServer(ctx context.Context, proxy *proxy.Client, cfg *config.ServerConfig) (*Server, error) {
+func NewServer(ctx context.Context, driver *Driver, cfg *config.ServerConfig) (*Server, error) {
 	host := "127.0.0.1"
 	port := 1080
 
@@ -33,29 +42,89 @@ func NewServer(ctx context.Context, proxy *proxy.Client, cfg *config.ServerConfi
 	}
 
 	s := &Server{
-		driver: &Driver{proxy: proxy},
+		ctx:    ctx,
+		driver: driver,
 		host:   host,
 		port:   port,
 	}
 
-	opts := []socks5.Option{
-		socks5.WithDriver(s.driver),
-		socks5.WithHost(host),
-		socks5.WithPort(port),
-		socks5.WithLogger(NewLogger(logging.Logger)),
+	if cfg.Auth {
+		s.auth = true
+		s.user = cfg.User
+		s.pass = cfg.Pass
 	}
 
-	if cfg.Auth {
-		opts = append(opts, socks5.WithPasswordAuthentication())
+	return s, nil
+}
 
-		opts = append(opts, socks5.WithStaticCredentials(map[string]string{cfg.User: cfg.Pass}))
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", net.JoinHostPort(s.host, strconv.Itoa(s.port)))
+	if err != nil {
+		return err
 	}
 
-	s.internal = socks5.New(opts...)
+	go func() {
+		<-s.ctx.Done()
+		_ = l.Close()
+	}()
 
-	return s, nil
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			logging.Logger.Error("failed to accept connection", "error", err)
+
+			continue
+		}
+
+		go s.serve(conn)
+	}
 }
 
-func (s *Server) ListenAndServe() error {
-	return s.internal.ListenAndServe()
+// serve dispatches a client connection on its protocol version byte
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	c := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	version, err := c.r.ReadByte()
+	if err != nil {
+		logging.Logger.Debug("failed to read protocol version", "error", err, "remote", conn.RemoteAddr())
+
+		return
+	}
+
+	switch version {
+	case socks5Version:
+		s.serveSOCKS5(c)
+	case socks4Version:
+		s.serveSOCKS4(c)
+	default:
+		logging.Logger.Warn("unsupported SOCKS version", "version", version, "remote", conn.RemoteAddr())
+	}
+}
+
+// bufferedConn is a net.Conn whose reads go through the handshake reader, so
+// bytes the client pipelined after its request are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite closes the write side of the underlying TCP connection
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
 }
@@ -0,0 +1,153 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+)
+
+const (
+	socks4Version byte = 0x04
+
+	socks4ReplyVersion byte = 0x00
+
+	socks4Granted  byte = 0x5a
+	socks4Rejected byte = 0x5b
+
+	// socks4MaxField bounds the null-terminated user ID and SOCKS4a hostname
+	socks4MaxField = 255
+)
+
+var (
+	errFieldTooLong = errors.New("SOCKS4 field too long")
+	errNoHostname   = errors.New("SOCKS4a request without a hostname")
+)
+
+// readSOCKS4Request reads a SOCKS4 or SOCKS4a request after its version byte.
+// A SOCKS4a request whose hostname is missing or unreadable fails with
+// errNoHostname, which the client is told about; other errors mean the
+// request could not be read at all.
+func readSOCKS4Request(r *bufio.Reader) (*request, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	command := hdr[0]
+	port := binary.BigEndian.Uint16(hdr[1:3])
+	ip := netip.AddrFrom4([4]byte(hdr[3:7]))
+
+	user, err := readNullTerminated(r)
+	if err != nil {
+		return nil, err
+	}
+
+	host := ip.String()
+
+	// SOCKS4a marks a hostname with a destination of 0.0.0.x, x non-zero. The
+	// name follows the user ID and is resolved like a SOCKS5 domain.
+	if b := ip.As4(); b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] != 0 {
+		host, err = readNullTerminated(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errNoHostname, err)
+		}
+
+		if host == "" {
+			return nil, errNoHostname
+		}
+	}
+
+	return &request{command: command, address: net.JoinHostPort(host, strconv.Itoa(int(port))), user: user}, nil
+}
+
+// serveSOCKS4 handles SOCKS4 and SOCKS4a CONNECT requests. The version byte
+// has already been consumed. SOCKS4 has no passwords, so it is refused when
+// the server requires authentication.
+func (s *Server) serveSOCKS4(conn *bufferedConn) {
+	req, err := readSOCKS4Request(conn.r)
+	if err != nil {
+		logging.Logger.Debug("failed to read SOCKS4 request", "error", err)
+
+		if errors.Is(err, errNoHostname) {
+			s.reply4(conn, socks4Rejected)
+		}
+
+		return
+	}
+
+	if s.auth {
+		logging.Logger.Warn("rejecting SOCKS4 request: authentication is required", "remote", conn.RemoteAddr())
+		s.reply4(conn, socks4Rejected)
+
+		return
+	}
+
+	if req.command != commandConnect {
+		s.reply4(conn, socks4Rejected)
+		return
+	}
+
+	target, err := s.driver.DialUser(req.user, "tcp", req.address)
+	if err != nil {
+		logging.Logger.Error("dial failed", "address", req.address, "error", err)
+		s.reply4(conn, socks4Rejected)
+
+		return
+	}
+
+	defer target.Close()
+
+	if err := s.reply4(conn, socks4Granted); err != nil {
+		return
+	}
+
+	logging.Logger.Info("dial", "address", req.address)
+
+	_ = conn.SetDeadline(time.Time{})
+
+	Relay(conn, target)
+}
+
+// reply4 writes a SOCKS4 reply. The address fields are only meaningful for
+// BIND, which is not supported, so they are left zero.
+func (s *Server) reply4(conn net.Conn, status byte) error {
+	b := []byte{socks4ReplyVersion, status, 0, 0, 0, 0, 0, 0}
+
+	if _, err := conn.Write(b); err != nil {
+		logging.Logger.Debug("failed to send reply", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// readNullTerminated reads a null-terminated SOCKS4 field
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var b bytes.Buffer
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		if c == 0 {
+			return b.String(), nil
+		}
+
+		if b.Len() == socks4MaxField {
+			return "", errFieldTooLong
+		}
+
+		b.WriteByte(c)
+	}
+}
@@ -0,0 +1,95 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func socks4Request(ip [4]byte, user string, host string) []byte {
+	b := append([]byte{commandConnect, 0x01, 0xbb}, ip[:]...)
+	b = append(append(b, user...), 0x00)
+
+	if host != "" {
+		b = append(append(b, host...), 0x00)
+	}
+
+	return b
+}
+
+func TestReadSOCKS4Request(t *testing.T) {
+	cases := map[string]struct {
+		in      []byte
+		address string
+		user    string
+		err     error
+	}{
+		"socks4": {
+			in:      socks4Request([4]byte{93, 184, 216, 34}, "alice", ""),
+			address: "93.184.216.34:443",
+			user:    "alice",
+		},
+		"socks4 without user": {
+			in:      socks4Request([4]byte{93, 184, 216, 34}, "", ""),
+			address: "93.184.216.34:443",
+		},
+		"socks4a": {
+			in:      socks4Request([4]byte{0, 0, 0, 1}, "alice+region=eu", "example.com"),
+			address: "example.com:443",
+			user:    "alice+region=eu",
+		},
+		"socks4a without hostname": {
+			in:  socks4Request([4]byte{0, 0, 0, 1}, "alice", ""),
+			err: errNoHostname,
+		},
+		"socks4a with empty hostname": {
+			in:  append(socks4Request([4]byte{0, 0, 0, 1}, "alice", ""), 0x00),
+			err: errNoHostname,
+		},
+		"user too long": {
+			in:  socks4Request([4]byte{93, 184, 216, 34}, strings.Repeat("a", socks4MaxField+1), ""),
+			err: errFieldTooLong,
+		},
+		"hostname too long": {
+			in:  socks4Request([4]byte{0, 0, 0, 1}, "", strings.Repeat("a", socks4MaxField+1)),
+			err: errFieldTooLong,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := readSOCKS4Request(bufio.NewReader(bytes.NewReader(tc.in)))
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected %v, got %v", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if req.command != commandConnect || req.address != tc.address || req.user != tc.user {
+				t.Errorf("got %+v, want address %q user %q", req, tc.address, tc.user)
+			}
+		})
+	}
+}
+
+func TestReadSOCKS4Request_Truncated(t *testing.T) {
+	full := socks4Request([4]byte{93, 184, 216, 34}, "alice", "")
+	for n := range len(full) {
+		_, err := readSOCKS4Request(bufio.NewReader(bytes.NewReader(full[:n])))
+		if err == nil {
+			t.Fatalf("expected an error for %d of %d bytes", n, len(full))
+		}
+
+		if errors.Is(err, errNoHostname) {
+			t.Errorf("%d bytes: a truncated SOCKS4 request is not a missing hostname", n)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package socks
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+)
+
+const (
+	socks5Version byte = 0x05
+
+	noAuthenticationRequired       byte = 0x00
+	usernamePasswordAuthentication byte = 0x02
+	noAcceptableMethods            byte = 0xff
+
+	usernamePasswordVersion byte = 0x01
+	usernamePasswordSuccess byte = 0x00
+	usernamePasswordFailure byte = 0x01
+
+	commandConnect      byte = 0x01
+	commandBind         byte = 0x02
+	commandUDPAssociate byte = 0x03
+
+	replySucceeded               byte = 0x00
+	replyGeneralFailure          byte = 0x01
+	replyConnectionNotAllowed    byte = 0x02
+	replyNetworkUnreachable      byte = 0x03
+	replyHostUnreachable         byte = 0x04
+	replyConnectionRefused       byte = 0x05
+	replyTTLExpired              byte = 0x06
+	replyCommandNotSupported     byte = 0x07
+	replyAddressTypeNotSupported byte = 0x08
+)
+
+// request is a parsed SOCKS request
+type request struct {
+	command byte
+	address string
+	user    string
+}
+
+// serveSOCKS5 runs method negotiation, authentication and the request phase of
+// RFC 1928. The version byte has already been consumed.
+func (s *Server) serveSOCKS5(conn *bufferedConn) {
+	user, ok := s.negotiate(conn)
+	if !ok {
+		return
+	}
+
+	req, err := readSOCKS5Request(conn)
+	if err != nil {
+		if errors.Is(err, errAddressTypeNotSupported) {
+			s.reply(conn, replyAddressTypeNotSupported, "")
+		}
+
+		logging.Logger.Debug("failed to read request", "error", err)
+
+		return
+	}
+
+	req.user = user
+
+	switch req.command {
+	case commandConnect:
+		s.connect(conn, req)
+	case commandBind:
+		s.bind(conn, req)
+	case commandUDPAssociate:
+		s.udpAssociate(conn, req)
+	default:
+		s.reply(conn, replyCommandNotSupported, "")
+	}
+}
+
+// readSOCKS5Request reads the request that follows authentication
+func readSOCKS5Request(r io.Reader) (*request, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("invalid request version %d", hdr[0])
+	}
+
+	address, err := readAddress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{command: hdr[1], address: address}, nil
+}
+
+// negotiate selects an authentication method and authenticates the client. It
+// returns the authenticated username, if any.
+func (s *Server) negotiate(conn *bufferedConn) (string, bool) {
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		logging.Logger.Debug("failed to read number of methods", "error", err)
+		return "", false
+	}
+
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		logging.Logger.Debug("failed to read methods", "error", err)
+		return "", false
+	}
+
+	// Without authentication, username/password is still preferred when the
+	// client offers it, so labels in the username reach the router
+	method := noAcceptableMethods
+	for _, m := range methods {
+		if m == usernamePasswordAuthentication {
+			method = m
+			break
+		}
+
+		if m == noAuthenticationRequired && !s.auth {
+			method = m
+		}
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil || method == noAcceptableMethods {
+		return "", false
+	}
+
+	if method == noAuthenticationRequired {
+		return "", true
+	}
+
+	return s.authenticate(conn)
+}
+
+// authenticate runs the username/password sub-negotiation of RFC 1929. The
+// password is checked against the username without its labels, and not at
+// all when the server does not require authentication.
+func (s *Server) authenticate(conn *bufferedConn) (string, bool) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil || hdr[0] != usernamePasswordVersion {
+		return "", false
+	}
+
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", false
+	}
+
+	var n [1]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return "", false
+	}
+
+	pass := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(string(user), "+")
+
+	userOK := subtle.ConstantTimeCompare([]byte(name), []byte(s.user)) == 1
+	passOK := subtle.ConstantTimeCompare(pass, []byte(s.pass)) == 1
+
+	if s.auth && (!userOK || !passOK) {
+		logging.Logger.Warn("SOCKS authentication failed", "user", string(user), "remote", conn.RemoteAddr())
+		_, _ = conn.Write([]byte{usernamePasswordVersion, usernamePasswordFailure})
+
+		return "", false
+	}
+
+	if _, err := conn.Write([]byte{usernamePasswordVersion, usernamePasswordSuccess}); err != nil {
+		return "", false
+	}
+
+	return string(user), true
+}
+
+// connect handles the CONNECT command
+func (s *Server) connect(conn *bufferedConn, req *request) {
+	target, err := s.driver.DialUser(req.user, "tcp", req.address)
+	if err != nil {
+		logging.Logger.Error("dial failed", "address", req.address, "error", err)
+		s.reply(conn, replyCode(err), "")
+
+		return
+	}
+
+	defer target.Close()
+
+	if err := s.reply(conn, replySucceeded, target.LocalAddr().String()); err != nil {
+		return
+	}
+
+	logging.Logger.Info("dial", "address", req.address)
+
+	_ = conn.SetDeadline(time.Time{})
+
+	Relay(conn, target)
+}
+
+// bind handles the BIND command. The first reply carries the address the exit
+// node listens on, the second the address of the peer that connected to it.
+func (s *Server) bind(conn *bufferedConn, req *request) {
+	b, err := s.driver.BindUser(req.user, req.address)
+	if err != nil {
+		logging.Logger.Error("bind failed", "address", req.address, "error", err)
+		s.reply(conn, replyCode(err), "")
+
+		return
+	}
+
+	defer b.Close()
+
+	if err := s.reply(conn, replySucceeded, b.Address()); err != nil {
+		return
+	}
+
+	logging.Logger.Info("bind", "address", req.address, "bound", b.Address())
+
+	_ = conn.SetDeadline(time.Time{})
+
+	stop := watchClose(conn, func() { _ = b.Close() })
+	target, remote, err := b.Accept()
+	stop()
+
+	if err != nil {
+		logging.Logger.Error("bind accept failed", "address", req.address, "error", err)
+		s.reply(conn, replyCode(err), "")
+
+		return
+	}
+
+	defer target.Close()
+
+	if err := s.reply(conn, replySucceeded, remote); err != nil {
+		return
+	}
+
+	Relay(conn, target)
+}
+
+// watchClose calls cancel if the client closes conn while the server waits on
+// something else. Peeking leaves any data the client sends in the buffer. The
+// returned func stops watching and must be called before conn is read again.
+func watchClose(conn *bufferedConn, cancel func()) func() {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if _, err := conn.r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			logging.Logger.Debug("client closed the connection while waiting", "error", err)
+			cancel()
+		}
+	}()
+
+	return func() {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// reply writes a SOCKS5 reply with the given status and bound address
+func (s *Server) reply(conn net.Conn, status byte, bound string) error {
+	b := []byte{socks5Version, status, 0x00}
+	b = appendAddress(b, bound)
+
+	if _, err := conn.Write(b); err != nil {
+		logging.Logger.Debug("failed to send reply", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// replyCode maps a dial error to the RFC 1928 reply code. Failures the exit
+// node reports carry a proxy.ErrorCode; anything else means the node itself
+// could not be reached and is reported as a general failure.
+func replyCode(err error) byte {
+	var perr *proxy.Error
+	if !errors.As(err, &perr) {
+		return replyGeneralFailure
+	}
+
+	switch perr.Code {
+	case proxy.CodeNotAllowed, proxy.CodeQuotaExceeded:
+		return replyConnectionNotAllowed
+	case proxy.CodeNetworkUnreachable:
+		return replyNetworkUnreachable
+	case proxy.CodeHostUnreachable, proxy.CodeDNSFailure:
+		return replyHostUnreachable
+	case proxy.CodeConnectionRefused:
+		return replyConnectionRefused
+	case proxy.CodeTimeout:
+		return replyTTLExpired
+	default:
+		return replyGeneralFailure
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay copies data in both directions and propagates EOF from one side as a
+// write close on the other. It returns when both directions are done; an error
+// in either direction tears down both connections.
+func Relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		if _, err := io.Copy(dst, src); err != nil {
+			_ = a.Close()
+			_ = b.Close()
+
+			return
+		}
+
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+	}
+
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
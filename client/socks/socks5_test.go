@@ -0,0 +1,107 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadSOCKS5Request(t *testing.T) {
+	cases := map[string]struct {
+		in      []byte
+		command byte
+		address string
+		err     error
+	}{
+		"ipv4": {
+			in:      []byte{0x05, commandConnect, 0x00, addressTypeIPv4, 93, 184, 216, 34, 0x01, 0xbb},
+			command: commandConnect,
+			address: "93.184.216.34:443",
+		},
+		"ipv6": {
+			in:      append(append([]byte{0x05, commandConnect, 0x00, addressTypeIPv6}, make([]byte, 15)...), 0x01, 0x00, 0x50),
+			command: commandConnect,
+			address: "[::1]:80",
+		},
+		"domain": {
+			in:      append(append([]byte{0x05, commandUDPAssociate, 0x00, addressTypeFQDN, 11}, "example.com"...), 0x00, 0x35),
+			command: commandUDPAssociate,
+			address: "example.com:53",
+		},
+		"unsupported address type": {
+			in:  []byte{0x05, commandConnect, 0x00, 0x02, 0x00, 0x50},
+			err: errAddressTypeNotSupported,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req, err := readSOCKS5Request(bytes.NewReader(tc.in))
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected %v, got %v", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if req.command != tc.command || req.address != tc.address {
+				t.Errorf("got command %#x address %q, want %#x %q", req.command, req.address, tc.command, tc.address)
+			}
+		})
+	}
+}
+
+func TestReadSOCKS5Request_Truncated(t *testing.T) {
+	requests := map[string][]byte{
+		"ipv4":   {0x05, commandConnect, 0x00, addressTypeIPv4, 93, 184, 216, 34, 0x01, 0xbb},
+		"ipv6":   append(append([]byte{0x05, commandConnect, 0x00, addressTypeIPv6}, make([]byte, 16)...), 0x00, 0x50),
+		"domain": append(append([]byte{0x05, commandConnect, 0x00, addressTypeFQDN, 11}, "example.com"...), 0x00, 0x50),
+	}
+
+	for name, full := range requests {
+		for n := range len(full) {
+			if _, err := readSOCKS5Request(bytes.NewReader(full[:n])); err == nil {
+				t.Errorf("%s: expected an error for %d of %d bytes", name, n, len(full))
+			}
+		}
+	}
+}
+
+func TestReadSOCKS5Request_RejectsVersion(t *testing.T) {
+	in := []byte{0x04, commandConnect, 0x00, addressTypeIPv4, 127, 0, 0, 1, 0x00, 0x50}
+	if _, err := readSOCKS5Request(bytes.NewReader(in)); err == nil {
+		t.Fatal("expected an error for a non-SOCKS5 request")
+	}
+}
+
+func TestDatagram_RoundTrip(t *testing.T) {
+	for _, addr := range []string{"93.184.216.34:53", "[2001:db8::1]:53", "example.com:53"} {
+		addr2, payload, err := parseDatagram(buildDatagram(addr, []byte("query")))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+
+		if addr2 != addr || string(payload) != "query" {
+			t.Errorf("got %q %q, want %q %q", addr2, payload, addr, "query")
+		}
+	}
+}
+
+func TestParseDatagram_Rejects(t *testing.T) {
+	cases := map[string][]byte{
+		"short":      {0x00, 0x00, 0x00},
+		"fragmented": {0x00, 0x00, 0x01, addressTypeIPv4, 127, 0, 0, 1, 0x00, 0x35},
+		"truncated":  {0x00, 0x00, 0x00, addressTypeIPv4, 127, 0},
+	}
+
+	for name, b := range cases {
+		if _, _, err := parseDatagram(b); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
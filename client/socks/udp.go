@@ -0,0 +1,226 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/henrybarreto/bethrou/client/route"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+)
+
+// udpAssociate handles the UDP ASSOCIATE command. The client-facing socket is
+// bound next to the SOCKS listener, while every datagram is routed like a
+// CONNECT to its destination: through an exit node, dropped when a rule blocks
+// it or sent from this machine when a rule routes it direct. The association
+// lives as long as the control connection.
+func (s *Server) udpAssociate(conn *bufferedConn, req *request) {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		host = s.host
+	}
+
+	local, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		logging.Logger.Error("failed to listen udp", "error", err)
+		s.reply(conn, replyGeneralFailure, "")
+
+		return
+	}
+
+	defer local.Close()
+
+	// The association for unmatched destinations is opened up front, so a
+	// network without usable nodes fails the request
+	remote, err := s.driver.ListenPacketAction(req.user, route.Action{}, "")
+	if err != nil {
+		logging.Logger.Error("failed to open udp association", "error", err)
+		s.reply(conn, replyCode(err), "")
+
+		return
+	}
+
+	r := &udpRelay{driver: s.driver, user: req.user, local: local, sockets: map[string]net.PacketConn{route.Action{}.String(): remote}}
+	defer r.close()
+
+	if err := s.reply(conn, replySucceeded, local.LocalAddr().String()); err != nil {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	clientHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	logging.Logger.Info("udp associate", "client", conn.RemoteAddr(), "bound", local.LocalAddr())
+
+	go r.deliver(remote)
+	go r.relay(net.ParseIP(clientHost))
+
+	_, _ = io.Copy(io.Discard, conn)
+
+	logging.Logger.Info("udp association closed", "client", conn.RemoteAddr())
+}
+
+// udpRelay moves the datagrams of one UDP association between the client and
+// one socket per routing action
+type udpRelay struct {
+	driver *Driver
+	user   string
+	local  net.PacketConn
+	client atomic.Pointer[net.UDPAddr]
+
+	mu      sync.Mutex
+	sockets map[string]net.PacketConn
+	closed  bool
+}
+
+// udpRoute is where datagrams to one destination go
+type udpRoute struct {
+	socket net.PacketConn
+	addr   net.Addr
+}
+
+// relay reads datagrams from the client and sends them on the socket of their
+// route. Routes are looked up once per destination.
+func (r *udpRelay) relay(clientIP net.IP) {
+	routes := make(map[string]*udpRoute)
+	buf := make([]byte, pkgnetwork.MaxDatagramSize)
+	for {
+		n, from, err := r.local.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		src, ok := from.(*net.UDPAddr)
+		if !ok || !src.IP.Equal(clientIP) {
+			continue
+		}
+
+		dst, payload, err := parseDatagram(buf[:n])
+		if err != nil {
+			logging.Logger.Debug("dropping udp datagram", "error", err)
+			continue
+		}
+
+		r.client.Store(src)
+
+		rt, ok := routes[dst]
+		if !ok {
+			rt = r.route(dst)
+			routes[dst] = rt
+		}
+
+		if rt == nil {
+			continue
+		}
+
+		if _, err := rt.socket.WriteTo(payload, rt.addr); err != nil {
+			logging.Logger.Debug("failed to relay udp datagram", "address", dst, "error", err)
+		}
+	}
+}
+
+// route picks the socket for datagrams to dst, opening it for the first
+// destination of its action. It returns nil when they are dropped.
+func (r *udpRelay) route(dst string) *udpRoute {
+	action, addr, err := r.driver.RoutePacket(r.user, dst)
+	if err != nil {
+		logging.Logger.Debug("dropping udp datagrams", "address", dst, "error", err)
+		return nil
+	}
+
+	key := action.String()
+
+	r.mu.Lock()
+	socket, ok := r.sockets[key]
+	r.mu.Unlock()
+
+	if !ok {
+		socket, err = r.driver.ListenPacketAction(r.user, action, dst)
+		if err != nil {
+			logging.Logger.Debug("dropping udp datagrams", "address", dst, "error", err)
+			return nil
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			_ = socket.Close()
+
+			return nil
+		}
+
+		r.sockets[key] = socket
+		r.mu.Unlock()
+
+		go r.deliver(socket)
+	}
+
+	return &udpRoute{socket: socket, addr: addr}
+}
+
+// deliver sends the datagrams arriving on socket back to the client
+func (r *udpRelay) deliver(socket net.PacketConn) {
+	buf := make([]byte, pkgnetwork.MaxDatagramSize)
+	for {
+		n, from, err := socket.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		dst := r.client.Load()
+		if dst == nil {
+			continue
+		}
+
+		if _, err := r.local.WriteTo(buildDatagram(from.String(), buf[:n]), dst); err != nil {
+			logging.Logger.Debug("failed to deliver udp datagram", "error", err)
+		}
+	}
+}
+
+// close closes every socket of the association
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	for _, socket := range r.sockets {
+		_ = socket.Close()
+	}
+}
+
+// parseDatagram splits a SOCKS5 UDP request header from its payload.
+// Fragmented datagrams are not supported and are rejected.
+func parseDatagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short udp datagram")
+	}
+
+	if b[2] != 0x00 {
+		return "", nil, errors.New("fragmented udp datagram")
+	}
+
+	r := bytes.NewReader(b[3:])
+
+	addr, err := readAddress(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// buildDatagram prefixes payload with a SOCKS5 UDP header for addr
+func buildDatagram(addr string, payload []byte) []byte {
+	b := make([]byte, 0, 22+len(payload))
+	b = append(b, 0x00, 0x00, 0x00)
+	b = appendAddress(b, addr)
+
+	return append(b, payload...)
+}
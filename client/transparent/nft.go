@@ -0,0 +1,131 @@
+package transparent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/henrybarreto/bethrou/client/config"
+)
+
+// Table is the nftables table the rules are installed in
+const Table = "bethrou"
+
+// Rules selects the traffic diverted to the transparent listener. Cgroup
+// matches TCP connections made by processes of a cgroup v2 path, relative to
+// the cgroup root. Iface matches TCP connections arriving on an interface,
+// such as the host side of the veth pair of a network namespace.
+type Rules struct {
+	Mode   string
+	Port   int
+	Cgroup string
+	Iface  string
+	// Mark and RouteTable route TPROXY traffic of a cgroup back to the local
+	// stack, where the prerouting hook can divert it
+	Mark       int
+	RouteTable int
+}
+
+func (r *Rules) validate() error {
+	if r.Port <= 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d", r.Port)
+	}
+
+	if (r.Cgroup == "") == (r.Iface == "") {
+		return errors.New("exactly one of cgroup or interface is required")
+	}
+
+	switch r.Mode {
+	case config.TransparentRedirect, config.TransparentTProxy:
+	default:
+		return fmt.Errorf("unsupported transparent mode: %s", r.Mode)
+	}
+
+	if r.Mode == config.TransparentTProxy && (r.Mark <= 0 || r.RouteTable <= 0) {
+		return errors.New("tproxy needs a mark and a routing table")
+	}
+
+	return nil
+}
+
+// match returns the nft expression selecting the diverted traffic
+func (r *Rules) match() string {
+	if r.Cgroup != "" {
+		path := strings.Trim(r.Cgroup, "/")
+		level := strings.Count(path, "/") + 1
+
+		return fmt.Sprintf("socket cgroupv2 level %d %q meta l4proto tcp", level, path)
+	}
+
+	return fmt.Sprintf("iifname %q meta l4proto tcp", r.Iface)
+}
+
+// Ruleset renders an nft script that replaces the bethrou table. Traffic to
+// local addresses is never diverted.
+func (r *Rules) Ruleset() (string, error) {
+	if err := r.validate(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	// Declaring the table first lets the delete succeed on a clean system.
+	fmt.Fprintf(&b, "table inet %s\n", Table)
+	fmt.Fprintf(&b, "delete table inet %s\n\n", Table)
+	fmt.Fprintf(&b, "table inet %s {\n", Table)
+
+	match := r.match()
+
+	switch {
+	case r.Mode == config.TransparentRedirect && r.Cgroup != "":
+		b.WriteString("\tchain output {\n")
+		b.WriteString("\t\ttype nat hook output priority dstnat; policy accept;\n")
+		b.WriteString("\t\tfib daddr type local return\n")
+		fmt.Fprintf(&b, "\t\t%s redirect to :%d\n", match, r.Port)
+		b.WriteString("\t}\n")
+	case r.Mode == config.TransparentRedirect:
+		b.WriteString("\tchain prerouting {\n")
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		b.WriteString("\t\tfib daddr type local return\n")
+		fmt.Fprintf(&b, "\t\t%s redirect to :%d\n", match, r.Port)
+		b.WriteString("\t}\n")
+	case r.Cgroup != "":
+		b.WriteString("\tchain output {\n")
+		b.WriteString("\t\ttype route hook output priority mangle; policy accept;\n")
+		b.WriteString("\t\tfib daddr type local return\n")
+		fmt.Fprintf(&b, "\t\t%s meta mark set %#x\n", match, r.Mark)
+		b.WriteString("\t}\n\n")
+		b.WriteString("\tchain prerouting {\n")
+		b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+		fmt.Fprintf(&b, "\t\tmeta mark %#x meta l4proto tcp tproxy to :%d accept\n", r.Mark, r.Port)
+		b.WriteString("\t}\n")
+	default:
+		b.WriteString("\tchain prerouting {\n")
+		b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+		b.WriteString("\t\tfib daddr type local return\n")
+		fmt.Fprintf(&b, "\t\t%s tproxy to :%d meta mark set %#x accept\n", match, r.Port, r.Mark)
+		b.WriteString("\t}\n")
+	}
+
+	b.WriteString("}\n")
+
+	return b.String(), nil
+}
+
+// Routes returns the ip commands TPROXY needs to deliver marked packets to the
+// local stack. REDIRECT needs none.
+func (r *Rules) Routes() [][]string {
+	if r.Mode != config.TransparentTProxy {
+		return nil
+	}
+
+	mark := fmt.Sprintf("%#x", r.Mark)
+	table := fmt.Sprint(r.RouteTable)
+
+	return [][]string{
+		{"ip", "-4", "rule", "add", "fwmark", mark, "lookup", table},
+		{"ip", "-4", "route", "replace", "local", "0.0.0.0/0", "dev", "lo", "table", table},
+		{"ip", "-6", "rule", "add", "fwmark", mark, "lookup", table},
+		{"ip", "-6", "route", "replace", "local", "::/0", "dev", "lo", "table", table},
+	}
+}
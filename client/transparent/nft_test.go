@@ -0,0 +1,107 @@
+package transparent
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/client/config"
+)
+
+func TestRules_Ruleset(t *testing.T) {
+	cases := map[string]struct {
+		rules Rules
+		want  []string
+	}{
+		"redirect cgroup": {
+			rules: Rules{Mode: config.TransparentRedirect, Port: 1081, Cgroup: "/user.slice/app"},
+			want: []string{
+				"type nat hook output priority dstnat;",
+				`socket cgroupv2 level 2 "user.slice/app" meta l4proto tcp redirect to :1081`,
+			},
+		},
+		"redirect interface": {
+			rules: Rules{Mode: config.TransparentRedirect, Port: 1081, Iface: "veth0"},
+			want: []string{
+				"type nat hook prerouting priority dstnat;",
+				`iifname "veth0" meta l4proto tcp redirect to :1081`,
+			},
+		},
+		"tproxy cgroup": {
+			rules: Rules{Mode: config.TransparentTProxy, Port: 1081, Cgroup: "app", Mark: 1, RouteTable: 100},
+			want: []string{
+				`socket cgroupv2 level 1 "app" meta l4proto tcp meta mark set 0x1`,
+				"meta mark 0x1 meta l4proto tcp tproxy to :1081 accept",
+			},
+		},
+		"tproxy interface": {
+			rules: Rules{Mode: config.TransparentTProxy, Port: 1081, Iface: "veth0", Mark: 1, RouteTable: 100},
+			want:  []string{`iifname "veth0" meta l4proto tcp tproxy to :1081 meta mark set 0x1 accept`},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			out, err := tc.rules.Ruleset()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !strings.HasPrefix(out, "table inet bethrou\ndelete table inet bethrou\n") {
+				t.Errorf("expected the table to be replaced:\n%s", out)
+			}
+
+			for _, s := range append(tc.want, "fib daddr type local return") {
+				if !strings.Contains(out, s) {
+					t.Errorf("expected %q in:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestRules_Invalid(t *testing.T) {
+	cases := map[string]Rules{
+		"port":        {Mode: config.TransparentRedirect, Cgroup: "app"},
+		"no match":    {Mode: config.TransparentRedirect, Port: 1081},
+		"two matches": {Mode: config.TransparentRedirect, Port: 1081, Cgroup: "app", Iface: "veth0"},
+		"mode":        {Mode: "divert", Port: 1081, Cgroup: "app"},
+		"tproxy mark": {Mode: config.TransparentTProxy, Port: 1081, Cgroup: "app"},
+	}
+
+	for name, r := range cases {
+		if _, err := r.Ruleset(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRules_Routes(t *testing.T) {
+	if routes := (&Rules{Mode: config.TransparentRedirect}).Routes(); routes != nil {
+		t.Errorf("expected no routes for redirect, got %v", routes)
+	}
+
+	routes := (&Rules{Mode: config.TransparentTProxy, Mark: 1, RouteTable: 100}).Routes()
+	if len(routes) != 4 || strings.Join(routes[0], " ") != "ip -4 rule add fwmark 0x1 lookup 100" {
+		t.Errorf("unexpected routes: %v", routes)
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	cases := []struct {
+		dst, listener string
+		want          bool
+	}{
+		{"127.0.0.1:1081", "127.0.0.1:1081", true},
+		{"10.0.0.5:1081", "0.0.0.0:1081", true},
+		{"10.0.0.5:1081", "[::]:1081", true},
+		{"10.0.0.5:443", "0.0.0.0:1081", false},
+		{"10.0.0.5:1081", "127.0.0.1:1081", false},
+	}
+
+	for _, tc := range cases {
+		if got := isSelf(netip.MustParseAddrPort(tc.dst), netip.MustParseAddrPort(tc.listener)); got != tc.want {
+			t.Errorf("isSelf(%s, %s) = %t, want %t", tc.dst, tc.listener, got, tc.want)
+		}
+	}
+}
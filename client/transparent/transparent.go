@@ -0,0 +1,98 @@
+package transparent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"github.com/henrybarreto/bethrou/client/socks"
+	"github.com/henrybarreto/bethrou/pkg/logging"
+)
+
+// Server takes connections diverted to it by the kernel and dials their
+// original destination through the Bethrou network
+type Server struct {
+	ctx    context.Context
+	driver *socks.Driver
+	addr   string
+	mode   string
+}
+
+func NewServer(ctx context.Context, driver *socks.Driver, cfg *config.TransparentConfig) (*Server, error) {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = config.TransparentRedirect
+	}
+
+	return &Server{ctx: ctx, driver: driver, addr: cfg.ListenAddr, mode: mode}, nil
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := listen(s.ctx, s.addr, s.mode)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-s.ctx.Done()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			logging.Logger.Error("failed to accept connection", "error", err)
+
+			continue
+		}
+
+		go s.serve(conn, l.Addr())
+	}
+}
+
+func (s *Server) serve(conn net.Conn, listenAddr net.Addr) {
+	defer conn.Close()
+
+	dst, err := originalDst(conn, s.mode)
+	if err != nil {
+		logging.Logger.Error("failed to recover original destination", "error", err, "remote", conn.RemoteAddr())
+		return
+	}
+
+	// A connection that was not diverted reports the listener itself as its
+	// destination, and dialing it would loop back here.
+	if self, ok := listenAddr.(*net.TCPAddr); ok && isSelf(dst, self.AddrPort()) {
+		logging.Logger.Warn("rejecting connection that was not diverted", "remote", conn.RemoteAddr())
+		return
+	}
+
+	address := dst.String()
+
+	target, err := s.driver.Dial("tcp", address)
+	if err != nil {
+		logging.Logger.Error("dial failed", "address", address, "error", err)
+		return
+	}
+
+	defer target.Close()
+
+	logging.Logger.Info("dial", "address", address, "remote", conn.RemoteAddr())
+
+	socks.Relay(conn, target)
+}
+
+func isSelf(dst, listener netip.AddrPort) bool {
+	if dst.Port() != listener.Port() {
+		return false
+	}
+
+	ip := listener.Addr().Unmap()
+
+	return ip.IsUnspecified() || ip == dst.Addr().Unmap()
+}
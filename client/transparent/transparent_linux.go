@@ -0,0 +1,118 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"github.com/henrybarreto/bethrou/client/config"
+	"golang.org/x/sys/unix"
+)
+
+// listen opens the transparent listener. TPROXY needs IP_TRANSPARENT on the
+// socket, which requires CAP_NET_ADMIN.
+func listen(ctx context.Context, addr string, mode string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+
+	if mode == config.TransparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if serr == nil && network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+
+			if serr != nil {
+				return fmt.Errorf("failed to set IP_TRANSPARENT: %w", serr)
+			}
+
+			return nil
+		}
+	}
+
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// originalDst returns the destination the client connected to before the
+// connection was diverted
+func originalDst(conn net.Conn, mode string) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected connection type %T", conn)
+	}
+
+	local := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+
+	// TPROXY keeps the original destination as the local address of the
+	// accepted socket.
+	if mode == config.TransparentTProxy {
+		return netip.AddrPortFrom(local.Addr().Unmap(), local.Port()), nil
+	}
+
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var serr error
+
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			dst, serr = originalDst4(int(fd))
+		} else {
+			dst, serr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	if serr != nil {
+		return netip.AddrPort{}, fmt.Errorf("SO_ORIGINAL_DST failed: %w", serr)
+	}
+
+	return dst, nil
+}
+
+// originalDst4 reads the sockaddr_in set by conntrack for a redirected IPv4
+// connection
+func originalDst4(fd int) (netip.AddrPort, error) {
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	b := mreq.Multiaddr
+	port := binary.BigEndian.Uint16(b[2:4])
+	ip := netip.AddrFrom4([4]byte(b[4:8]))
+
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// originalDst6 reads the sockaddr_in6 set by conntrack for a redirected IPv6
+// connection. IP6T_SO_ORIGINAL_DST has the same value as SO_ORIGINAL_DST.
+func originalDst6(fd int) (netip.AddrPort, error) {
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	port := binary.BigEndian.Uint16(p[:])
+	ip := netip.AddrFrom16(info.Addr.Addr).Unmap()
+
+	return netip.AddrPortFrom(ip, port), nil
+}
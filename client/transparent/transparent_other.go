@@ -0,0 +1,20 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+func listen(context.Context, string, string) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+func originalDst(net.Conn, string) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errUnsupported
+}
@@ -2,7 +2,11 @@ module github.com/henrybarreto/bethrou
 
 go 1.24.7
 
-require github.com/redis/go-redis/v9 v9.14.0
+require (
+	github.com/redis/go-redis/v9 v9.14.0
+	golang.org/x/time v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/benbjohnson/clock v1.3.5 // indirect
@@ -78,7 +82,6 @@ require (
 	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
-	golang.org/x/time v0.12.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 )
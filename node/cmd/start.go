@@ -3,6 +3,9 @@ package cmd
 import (
 	"context"
 	stdlog "log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/henrybarreto/bethrou/node/server"
 	pkgconfig "github.com/henrybarreto/bethrou/pkg/config"
@@ -19,6 +22,13 @@ var (
 	discoverUser    string
 	discoverPass    string
 	discoverTopic   string
+	policyPath      string
+	limitsPath      string
+	usagePath       string
+	forward         bool
+	labels          map[string]string
+	weight          int
+	priority        int
 )
 
 func init() {
@@ -31,6 +41,13 @@ func init() {
 	startCmd.Flags().StringVar(&discoverUser, "discover-user", "", "Optional redis username for discover")
 	startCmd.Flags().StringVar(&discoverPass, "discover-pass", "", "Optional redis password for discover")
 	startCmd.Flags().StringVar(&discoverTopic, "discover-topic", "", "Topic to subscribe for discover messages (defaults to node ID)")
+	startCmd.Flags().StringVar(&policyPath, "policy", "", "Path to egress policy file (reloaded on SIGHUP; defaults to secure built-in rules)")
+	startCmd.Flags().StringVar(&limitsPath, "limits", "", "Path to per-peer bandwidth and stream limits file (reloaded on SIGHUP; unlimited when unset)")
+	startCmd.Flags().StringVar(&usagePath, "usage", "", "Path to the per-peer usage ledger (usage is kept in memory only when unset)")
+	startCmd.Flags().BoolVar(&forward, "forward", true, "Forward client circuits to other nodes as an entry or middle hop")
+	startCmd.Flags().IntVar(&weight, "weight", 0, "Share of traffic announced through discovery for the weighted strategy (0 counts as 1)")
+	startCmd.Flags().IntVar(&priority, "priority", 0, "Priority tier announced through discovery; clients use higher values only when lower tiers are unhealthy")
+	startCmd.Flags().StringToStringVar(&labels, "label", nil, "Label announced through discovery, as key=value (repeatable, e.g. --label region=eu)")
 
 	rootCmd.AddCommand(startCmd)
 }
@@ -39,13 +56,20 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start node",
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
 		cfg := &server.Config{
 			Listen:       listen,
 			RelayMode:    relayMode,
 			ConnectRelay: connectRelay,
+			Policy:       policyPath,
+			Limits:       limitsPath,
+			Usage:        usagePath,
+			Forward:      forward,
+			Labels:       labels,
+			Weight:       weight,
+			Priority:     priority,
 			Discovery: pkgconfig.DiscoveryConfig{
 				Enabled: discoverEnable,
 				Address: discoverAddress,
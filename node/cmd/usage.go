@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/usage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	usageFile   string
+	usagePeriod string
+	usageFormat string
+	usagePeer   string
+)
+
+func init() {
+	usageCmd.Flags().StringVar(&usageFile, "file", "", "Path to the usage ledger written by the node (its --usage flag)")
+	usageCmd.Flags().StringVar(&usagePeriod, "period", string(usage.Monthly), "Roll-up to show: daily, monthly or all")
+	usageCmd.Flags().StringVar(&usageFormat, "format", "table", "Output format: table, csv or json")
+	usageCmd.Flags().StringVar(&usagePeer, "peer", "", "Only show usage of this peer ID")
+	_ = usageCmd.MarkFlagRequired("file")
+
+	rootCmd.AddCommand(usageCmd)
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Show per-peer traffic recorded by the node",
+	Long:  "Show per-peer traffic recorded by the node. The ledger is saved every minute, so the totals of a running node may lag slightly.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(usageFile); err != nil {
+			return fmt.Errorf("no usage ledger at %s: %w", usageFile, err)
+		}
+
+		ledger, err := usage.Open(usageFile)
+		if err != nil {
+			return err
+		}
+
+		rows, err := ledger.Report(usage.Period(usagePeriod))
+		if err != nil {
+			return err
+		}
+
+		if usagePeer != "" {
+			filtered := rows[:0]
+			for _, r := range rows {
+				if r.Peer == usagePeer {
+					filtered = append(filtered, r)
+				}
+			}
+
+			rows = filtered
+		}
+
+		switch usageFormat {
+		case "table":
+			return writeUsageTable(cmd.OutOrStdout(), rows)
+		case "csv":
+			return writeUsageCSV(cmd.OutOrStdout(), rows)
+		case "json":
+			return writeUsageJSON(cmd.OutOrStdout(), rows)
+		default:
+			return fmt.Errorf("unknown format %q", usageFormat)
+		}
+	},
+}
+
+func writeUsageTable(w io.Writer, rows []usage.Row) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PEER\tPERIOD\tBYTES IN\tBYTES OUT\tSTREAMS\tDURATION")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\n", r.Peer, r.Period, r.BytesIn, r.BytesOut, r.Streams, r.Duration.Round(time.Second))
+	}
+
+	return tw.Flush()
+}
+
+func writeUsageCSV(w io.Writer, rows []usage.Row) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"peer", "period", "bytes_in", "bytes_out", "streams", "duration_seconds"}); err != nil {
+		return err
+	}
+
+	for _, r := range rows {
+		err := cw.Write([]string{
+			r.Peer,
+			r.Period,
+			strconv.FormatUint(r.BytesIn, 10),
+			strconv.FormatUint(r.BytesOut, 10),
+			strconv.FormatUint(r.Streams, 10),
+			strconv.FormatFloat(r.Duration.Seconds(), 'f', 0, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+func writeUsageJSON(w io.Writer, rows []usage.Row) error {
+	if rows == nil {
+		rows = []usage.Row{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(rows)
+}
@@ -5,27 +5,46 @@ import (
 	"fmt"
 	stdlog "log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/henrybarreto/bethrou/node/identity"
 	pkgconfig "github.com/henrybarreto/bethrou/pkg/config"
 	"github.com/henrybarreto/bethrou/pkg/discovery"
 	"github.com/henrybarreto/bethrou/pkg/host"
+	"github.com/henrybarreto/bethrou/pkg/limits"
 	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/policy"
 	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/henrybarreto/bethrou/pkg/usage"
 )
 
+// usageFlushInterval is how often the usage ledger is written to disk
+const usageFlushInterval = time.Minute
+
 // Config is deprecated, use config.Config instead.
 type Config struct {
 	Key          string
 	Listen       string
 	RelayMode    bool
 	ConnectRelay string
+	Policy       string
+	Limits       string
+	Usage        string
+	Forward      bool
 	Discovery    pkgconfig.DiscoveryConfig
+	// Labels describe the node to clients, which can select exits by them
+	Labels map[string]string
+	// Weight and Priority place the node in the weighted strategy of clients
+	// that discover it
+	Weight   int
+	Priority int
 }
 
 func (c *Config) String() string {
-	return fmt.Sprintf("{Address: %s, RelayMode: %t, ConnectRelay: %s, DiscoverEnabled: %t, DiscoverAddress: %s, DiscoverUser: %s, DiscoverTopic: %s, Key: %s}",
-		c.Listen, c.RelayMode, c.ConnectRelay, c.Discovery.Enabled, c.Discovery.Address, c.Discovery.User, c.Discovery.Topic, c.Key)
+	return fmt.Sprintf("{Address: %s, RelayMode: %t, ConnectRelay: %s, Policy: %s, Limits: %s, Usage: %s, Forward: %t, DiscoverEnabled: %t, DiscoverAddress: %s, DiscoverUser: %s, DiscoverTopic: %s, Labels: %v, Weight: %d, Priority: %d, Key: %s}",
+		c.Listen, c.RelayMode, c.ConnectRelay, c.Policy, c.Limits, c.Usage, c.Forward, c.Discovery.Enabled, c.Discovery.Address, c.Discovery.User, c.Discovery.Topic, c.Labels, c.Weight, c.Priority, c.Key)
 }
 
 func Start(ctx context.Context, cfg *Config) error {
@@ -76,7 +95,55 @@ func Start(ctx context.Context, cfg *Config) error {
 		}
 	}()
 
-	srv := proxy.NewServer(h.Host())
+	pol := policy.Default()
+	if cfg.Policy != "" {
+		pol, err = policy.Load(cfg.Policy)
+		if err != nil {
+			return fmt.Errorf("failed to load policy: %w", err)
+		}
+
+		logging.Logger.Info("Loaded egress policy", "path", cfg.Policy)
+
+		go reloadOnHangup(ctx, "egress policy", pol, cfg.Policy)
+	} else {
+		logging.Logger.Info("No egress policy set; using secure defaults")
+	}
+
+	lim := limits.Unlimited()
+	if cfg.Limits != "" {
+		lim, err = limits.Load(cfg.Limits)
+		if err != nil {
+			return fmt.Errorf("failed to load limits: %w", err)
+		}
+
+		logging.Logger.Info("Loaded limits", "path", cfg.Limits)
+
+		go reloadOnHangup(ctx, "limits", lim, cfg.Limits)
+	} else {
+		logging.Logger.Info("No limits set; streams are not limited")
+	}
+
+	ledger := usage.InMemory()
+	if cfg.Usage != "" {
+		ledger, err = usage.Open(cfg.Usage)
+		if err != nil {
+			return fmt.Errorf("failed to open usage ledger: %w", err)
+		}
+
+		logging.Logger.Info("Recording usage", "path", cfg.Usage)
+
+		go flushUsage(ctx, ledger, cfg.Usage)
+	} else {
+		logging.Logger.Info("No usage ledger set; usage is kept in memory only")
+	}
+
+	defer func() {
+		if err := ledger.Flush(); err != nil {
+			logging.Logger.Error("Failed to save usage ledger", "path", cfg.Usage, "error", err)
+		}
+	}()
+
+	srv := proxy.NewServer(h.Host(), proxy.ServerConfig{Policy: pol, Limits: lim, Usage: ledger, NoForward: !cfg.Forward})
 
 	logging.Logger.Info("Exit node ready, listening for proxy streams")
 	logging.Logger.Info("Full exit node addresses")
@@ -86,16 +153,25 @@ func Start(ctx context.Context, cfg *Config) error {
 
 	if cfg.Discovery.Enabled {
 		dsv, err := discovery.NewService(discovery.Config{
-			Address: cfg.Discovery.Address,
-			User:    cfg.Discovery.User,
-			Pass:    cfg.Discovery.Pass,
-			Topic:   cfg.Discovery.Topic,
+			Address:  cfg.Discovery.Address,
+			User:     cfg.Discovery.User,
+			Pass:     cfg.Discovery.Pass,
+			Topic:    cfg.Discovery.Topic,
+			Labels:   cfg.Labels,
+			Weight:   cfg.Weight,
+			Priority: cfg.Priority,
 		}, h.Host())
 		if err != nil {
 			return fmt.Errorf("failed to create discovery service: %w", err)
 		}
 
+		// The service is closed once Start returns, so its leave
+		// announcement goes out before shutdown
+		stopped := make(chan struct{})
+
 		defer func() {
+			<-stopped
+
 			if err := dsv.Close(); err != nil {
 				logging.Logger.Error("Error closing discovery service", "error", err)
 			}
@@ -103,6 +179,8 @@ func Start(ctx context.Context, cfg *Config) error {
 
 		errCh := make(chan error, 1)
 		go func() {
+			defer close(stopped)
+
 			if err := dsv.Start(ctx); err != nil && err != context.Canceled {
 				errCh <- fmt.Errorf("discovery service error: %w", err)
 			}
@@ -123,3 +201,47 @@ func Start(ctx context.Context, cfg *Config) error {
 	logging.Logger.Info("Shutting down node")
 	return nil
 }
+
+// reloader is a configuration that can be re-read from its file
+type reloader interface {
+	Reload() error
+}
+
+// reloadOnHangup re-reads a configuration file every time the node receives
+// SIGHUP
+func reloadOnHangup(ctx context.Context, name string, r reloader, path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-sig:
+			if err := r.Reload(); err != nil {
+				logging.Logger.Error("Failed to reload "+name+"; keeping previous settings", "path", path, "error", err)
+				continue
+			}
+
+			logging.Logger.Info("Reloaded "+name, "path", path)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushUsage writes the usage ledger to disk periodically
+func flushUsage(ctx context.Context, ledger *usage.Ledger, path string) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ledger.Flush(); err != nil {
+				logging.Logger.Error("Failed to save usage ledger", "path", path, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
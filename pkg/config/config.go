@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 // NodeConfig represents a network node with its addresses and optional relay
@@ -10,6 +11,15 @@ type NodeConfig struct {
 	ID    string   `yaml:"id" json:"id"`
 	Addrs []string `yaml:"addrs" json:"addrs"`
 	Relay string   `yaml:"relay,omitempty" json:"relay,omitempty"`
+	// Labels are free-form attributes such as region or provider that
+	// routing rules select nodes by
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Weight is the node's share of traffic within its priority tier under
+	// the weighted strategy. Zero counts as one.
+	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
+	// Priority is the node's tier under the weighted strategy. Lower values
+	// are preferred; a tier is only used when every lower one is unhealthy.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
 }
 
 // Validate checks if the node configuration is valid
@@ -22,6 +32,10 @@ func (n *NodeConfig) Validate() error {
 		return errors.New("at least one address or relay is required")
 	}
 
+	if n.Weight < 0 || n.Priority < 0 {
+		return errors.New("node weight and priority cannot be negative")
+	}
+
 	return nil
 }
 
@@ -33,6 +47,12 @@ type DiscoveryConfig struct {
 	Timeout string `yaml:"timeout"`
 	User    string `yaml:"user"`
 	Pass    string `yaml:"pass"`
+	// Interval is how often a client repeats discovery to keep its pool in
+	// sync. Nodes also announce joining and leaving as they happen.
+	Interval string `yaml:"interval,omitempty"`
+	// Rounds is how many discovery rounds in a row a node may miss before a
+	// client removes it
+	Rounds int `yaml:"rounds,omitempty"`
 }
 
 // Validate checks if the discovery configuration is valid
@@ -49,6 +69,16 @@ func (d *DiscoveryConfig) Validate() error {
 		return errors.New("discovery topic is required when discovery is enabled")
 	}
 
+	if d.Interval != "" {
+		if i, err := time.ParseDuration(d.Interval); err != nil || i <= 0 {
+			return fmt.Errorf("invalid discovery interval: %q", d.Interval)
+		}
+	}
+
+	if d.Rounds < 0 {
+		return fmt.Errorf("invalid discovery rounds: %d", d.Rounds)
+	}
+
 	return nil
 }
 
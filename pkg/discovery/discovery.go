@@ -13,16 +13,52 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// Actions of the messages published on the discovery topic
+const (
+	// ActionDiscover asks every node to publish its info to the reply topic
+	ActionDiscover = "discover"
+	// ActionJoin announces a node that started serving
+	ActionJoin = "join"
+	// ActionLeave announces a node that is shutting down
+	ActionLeave = "leave"
+)
+
+// announceTimeout bounds how long publishing the leave announcement may take
+// while the node shuts down
+const announceTimeout = 5 * time.Second
+
 // Request represents a discovery request message
 type Request struct {
 	Action string `json:"action"`
 	Replay string `json:"reply,omitempty"`
+	// Node is the announced node of join and leave messages
+	Node *Response `json:"node,omitempty"`
 }
 
 // Response represents a discovery response message
 type Response struct {
-	ID    string   `json:"id"`
-	Addrs []string `json:"addrs"`
+	ID       string            `json:"id"`
+	Addrs    []string          `json:"addrs"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Weight   int               `json:"weight,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+}
+
+// NodeConfig returns the node described by the response
+func (r *Response) NodeConfig() config.NodeConfig {
+	return config.NodeConfig{
+		ID:       r.ID,
+		Addrs:    r.Addrs,
+		Labels:   r.Labels,
+		Weight:   r.Weight,
+		Priority: r.Priority,
+	}
+}
+
+// Event is a join or leave announced on the discovery topic
+type Event struct {
+	Action string
+	Node   config.NodeConfig
 }
 
 // Config contains configuration for the discovery service
@@ -32,6 +68,11 @@ type Config struct {
 	Timeout time.Duration
 	User    string
 	Pass    string
+	// Labels, Weight and Priority are announced with the node's addresses in
+	// server mode
+	Labels   map[string]string
+	Weight   int
+	Priority int
 }
 
 // Service handles discovery operations using Redis pub/sub
@@ -111,6 +152,19 @@ func (s *Service) Start(ctx context.Context) error {
 	ch := pubsub.Channel()
 	logging.Logger.Info("Subscribed to discovery topic", "topic", topic)
 
+	if err := s.announce(ctx, topic, ActionJoin); err != nil {
+		logging.Logger.Warn("Failed to announce join", "error", err)
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+		defer cancel()
+
+		if err := s.announce(ctx, topic, ActionLeave); err != nil {
+			logging.Logger.Warn("Failed to announce leave", "error", err)
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -129,6 +183,45 @@ func (s *Service) Start(ctx context.Context) error {
 	}
 }
 
+// Watch calls fn for every join and leave announced on the discovery topic
+// until ctx ends
+func (s *Service) Watch(ctx context.Context, fn func(Event)) error {
+	pubsub := s.client.Subscribe(ctx, s.config.Topic)
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe to topic %s: %w", s.config.Topic, err)
+	}
+
+	ch := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			var req Request
+			if err := json.Unmarshal([]byte(msg.Payload), &req); err != nil {
+				continue
+			}
+
+			switch req.Action {
+			case ActionJoin, ActionLeave:
+				if req.Node == nil || req.Node.ID == "" {
+					logging.Logger.Warn("discovery: ignoring announcement without a node", "action", req.Action)
+					continue
+				}
+
+				fn(Event{Action: req.Action, Node: req.Node.NodeConfig()})
+			}
+		}
+	}
+}
+
 // Close closes the discovery service
 func (s *Service) Close() error {
 	if s.client != nil {
@@ -140,7 +233,7 @@ func (s *Service) Close() error {
 // publishDiscovery publishes a discovery request to the discovery topic
 func (s *Service) publishDiscovery(ctx context.Context, replay string) error {
 	req := Request{
-		Action: "discover",
+		Action: ActionDiscover,
 		Replay: replay,
 	}
 
@@ -190,15 +283,8 @@ LOOP:
 				return nil, fmt.Errorf("incomplete response: missing ID or addresses")
 			}
 
-			node := &config.NodeConfig{
-				ID:    resp.ID,
-				Addrs: resp.Addrs,
-			}
-
-			if node != nil && node.ID != "" {
-				if _, exists := discoveredMap[node.ID]; !exists {
-					discoveredMap[node.ID] = *node
-				}
+			if _, exists := discoveredMap[resp.ID]; !exists {
+				discoveredMap[resp.ID] = resp.NodeConfig()
 			}
 		}
 	}
@@ -224,33 +310,55 @@ func (s *Service) process(ctx context.Context, payload string) error {
 		return nil
 	}
 
-	reply := req.Replay
-	if reply == "" {
-		logging.Logger.Warn("discovery: no reply topic in message, ignoring", "req", req)
+	if req.Action != "" && req.Action != ActionDiscover {
+		logging.Logger.Debug("discovery: ignoring message with action", "action", req.Action)
 		return nil
 	}
 
-	if req.Action != "" && req.Action != "discover" {
-		logging.Logger.Debug("discovery: ignoring message with action", "action", req.Action)
+	reply := req.Replay
+	if reply == "" {
+		logging.Logger.Warn("discovery: no reply topic in message, ignoring", "req", req)
 		return nil
 	}
 
 	return s.publish(ctx, reply)
 }
 
-// publish publishes this node's information to a reply topic
-func (s *Service) publish(ctx context.Context, reply string) error {
+// info describes this node
+func (s *Service) info() *Response {
 	addrs := make([]string, 0, len(s.host.Addrs()))
 	for _, a := range s.host.Addrs() {
 		addrs = append(addrs, a.String()+"/p2p/"+s.host.ID().String())
 	}
 
-	resp := Response{
-		ID:    s.host.ID().String(),
-		Addrs: addrs,
+	return &Response{
+		ID:       s.host.ID().String(),
+		Addrs:    addrs,
+		Labels:   s.config.Labels,
+		Weight:   s.config.Weight,
+		Priority: s.config.Priority,
+	}
+}
+
+// announce publishes a join or leave of this node to the topic
+func (s *Service) announce(ctx context.Context, topic string, action string) error {
+	b, err := json.Marshal(Request{Action: action, Node: s.info()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal announcement: %w", err)
+	}
+
+	if err := s.client.Publish(ctx, topic, string(b)).Err(); err != nil {
+		return fmt.Errorf("failed to publish %s announcement: %w", action, err)
 	}
 
-	b, err := json.Marshal(resp)
+	logging.Logger.Info("discovery: announced node", "action", action, "topic", topic)
+
+	return nil
+}
+
+// publish publishes this node's information to a reply topic
+func (s *Service) publish(ctx context.Context, reply string) error {
+	b, err := json.Marshal(s.info())
 	if err != nil {
 		return fmt.Errorf("failed to marshal response: %w", err)
 	}
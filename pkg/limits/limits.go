@@ -0,0 +1,426 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// chunkSize is the largest amount of data read or written before waiting on
+// the token buckets. It is also the bucket burst, so a shaped stream never
+// gets ahead of its rate by more than one chunk.
+const chunkSize = 32 * 1024
+
+// sweepInterval is how often idle peer state is looked for
+const sweepInterval = time.Minute
+
+var ErrTooManyStreams = errors.New("too many concurrent streams")
+
+// Size is an amount of data in bytes. In YAML it can be written as a plain
+// number or with a unit suffix, such as "512KiB" or "10GB".
+type Size int64
+
+// Rate is a bandwidth in bytes per second, written like a Size
+type Rate int64
+
+var units = []struct {
+	suffix string
+	factor int64
+}{
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"tib", 1 << 40},
+	{"kb", 1000},
+	{"mb", 1000 * 1000},
+	{"gb", 1000 * 1000 * 1000},
+	{"tb", 1000 * 1000 * 1000 * 1000},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"t", 1 << 40},
+	{"b", 1},
+}
+
+// ParseSize parses an amount such as "10GiB" into bytes
+func ParseSize(s string) (Size, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return Size(n * float64(factor)), nil
+}
+
+// ParseRate parses a bandwidth such as "10MiB" or "10MiB/s" into bytes per
+// second
+func ParseRate(s string) (Rate, error) {
+	v, err := ParseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return Rate(v), nil
+}
+
+func (s *Size) UnmarshalYAML(n *yaml.Node) error {
+	v, err := ParseSize(n.Value)
+	if err != nil {
+		return err
+	}
+
+	*s = v
+
+	return nil
+}
+
+func (r *Rate) UnmarshalYAML(n *yaml.Node) error {
+	v, err := ParseRate(n.Value)
+	if err != nil {
+		return err
+	}
+
+	*r = v
+
+	return nil
+}
+
+// Limit bounds the traffic of one peer or of the whole node. Upload is data
+// sent by the client towards its destinations and Download the data sent back.
+// MonthlyQuota caps both directions combined over a calendar month (UTC) and
+// only applies to peers. A zero field means unlimited.
+type Limit struct {
+	Upload       Rate `yaml:"upload,omitempty"`
+	Download     Rate `yaml:"download,omitempty"`
+	Streams      int  `yaml:"streams,omitempty"`
+	MonthlyQuota Size `yaml:"monthly_quota,omitempty"`
+}
+
+// Config is the on-disk limits format. Global caps the node as a whole, on
+// top of the per-peer limits. A peer listed under Peers uses its own entry
+// instead of Default.
+type Config struct {
+	Global  Limit            `yaml:"global"`
+	Default Limit            `yaml:"default"`
+	Peers   map[string]Limit `yaml:"peers"`
+}
+
+// state tracks the buckets and open streams of one peer or of the node
+type state struct {
+	limit    Limit
+	upload   *rate.Limiter
+	download *rate.Limiter
+	streams  int
+}
+
+func newState(l Limit) *state {
+	st := &state{
+		upload:   rate.NewLimiter(rate.Inf, chunkSize),
+		download: rate.NewLimiter(rate.Inf, chunkSize),
+	}
+	st.apply(l)
+
+	return st
+}
+
+// apply updates the state to a new limit, keeping its open streams
+func (st *state) apply(l Limit) {
+	st.limit = l
+	st.upload.SetLimit(limitOf(l.Upload))
+	st.download.SetLimit(limitOf(l.Download))
+}
+
+func (st *state) full() bool {
+	return st.limit.Streams > 0 && st.streams >= st.limit.Streams
+}
+
+// idle reports whether the state has no open streams and its buckets have
+// refilled, so dropping it is the same as keeping it
+func (st *state) idle(now time.Time) bool {
+	return st.streams == 0 && st.upload.TokensAt(now) >= chunkSize && st.download.TokensAt(now) >= chunkSize
+}
+
+func limitOf(r Rate) rate.Limit {
+	if r <= 0 {
+		return rate.Inf
+	}
+
+	return rate.Limit(r)
+}
+
+// Limiter enforces bandwidth and concurrent stream limits per remote peer and
+// for the whole node. It is safe for concurrent use and can be reloaded from
+// its file at runtime.
+type Limiter struct {
+	path string
+
+	mu     sync.Mutex
+	def    Limit
+	custom map[peer.ID]Limit
+	global *state
+	peers  map[peer.ID]*state
+	swept  time.Time
+}
+
+// Unlimited returns a limiter that only counts streams
+func Unlimited() *Limiter {
+	l, err := compile(&Config{})
+	if err != nil {
+		panic(err)
+	}
+
+	return l
+}
+
+// Load reads limits from a YAML file
+func Load(path string) (*Limiter, error) {
+	l := &Limiter{path: path, global: newState(Limit{}), peers: make(map[peer.ID]*state)}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reload re-reads the limits file. On error the current limits are kept.
+// Streams already open keep running and count against the new limits.
+func (l *Limiter) Reload() error {
+	if l.path == "" {
+		return errors.New("limits have no file to reload")
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read limits file: %w", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse limits file: %w", err)
+	}
+
+	nl, err := compile(&cfg)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.def = nl.def
+	l.custom = nl.custom
+	l.global.apply(nl.global.limit)
+
+	for id, st := range l.peers {
+		st.apply(l.limitFor(id))
+	}
+
+	return nil
+}
+
+func compile(cfg *Config) (*Limiter, error) {
+	if cfg.Global.Streams < 0 || cfg.Default.Streams < 0 {
+		return nil, errors.New("stream limits must not be negative")
+	}
+
+	custom := make(map[peer.ID]Limit, len(cfg.Peers))
+	for s, lim := range cfg.Peers {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q: %w", s, err)
+		}
+
+		if lim.Streams < 0 {
+			return nil, fmt.Errorf("peer %s: stream limit must not be negative", s)
+		}
+
+		custom[id] = lim
+	}
+
+	return &Limiter{
+		def:    cfg.Default,
+		custom: custom,
+		global: newState(cfg.Global),
+		peers:  make(map[peer.ID]*state),
+	}, nil
+}
+
+// limitFor returns the limit that applies to p. The caller must hold l.mu.
+func (l *Limiter) limitFor(p peer.ID) Limit {
+	if lim, ok := l.custom[p]; ok {
+		return lim
+	}
+
+	return l.def
+}
+
+// Acquire reserves a stream slot for p. It returns ErrTooManyStreams when the
+// peer or the node is at its stream limit. The returned lease must be released
+// once the stream is done.
+func (l *Limiter) Acquire(p peer.ID) (*Lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(time.Now())
+
+	st, ok := l.peers[p]
+	if !ok {
+		st = newState(l.limitFor(p))
+		l.peers[p] = st
+	}
+
+	if st.full() {
+		return nil, fmt.Errorf("%w: peer limit of %d reached", ErrTooManyStreams, st.limit.Streams)
+	}
+
+	if l.global.full() {
+		return nil, fmt.Errorf("%w: node limit of %d reached", ErrTooManyStreams, l.global.limit.Streams)
+	}
+
+	st.streams++
+	l.global.streams++
+
+	return &Lease{l: l, peer: st}, nil
+}
+
+// sweep drops the state of idle peers, so peers that come and go do not pile
+// up. A peer's state is kept until its buckets have refilled, so reconnecting
+// does not earn it a fresh burst. The caller must hold l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+
+	l.swept = now
+
+	for id, st := range l.peers {
+		if st.idle(now) {
+			delete(l.peers, id)
+		}
+	}
+}
+
+// Quota returns the monthly quota of p in bytes, or zero when it has none
+func (l *Limiter) Quota(p peer.ID) Size {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limitFor(p).MonthlyQuota
+}
+
+// Streams returns the number of open streams of p
+func (l *Limiter) Streams(p peer.ID) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if st, ok := l.peers[p]; ok {
+		return st.streams
+	}
+
+	return 0
+}
+
+// Lease is a stream slot held by a peer. Data moved through its Reader and
+// Writer is shaped by the peer and node buckets.
+type Lease struct {
+	l    *Limiter
+	peer *state
+	once sync.Once
+}
+
+// Release frees the stream slot. It is safe to call more than once.
+func (ls *Lease) Release() {
+	ls.once.Do(func() {
+		ls.l.mu.Lock()
+		defer ls.l.mu.Unlock()
+
+		ls.peer.streams--
+		ls.l.global.streams--
+	})
+}
+
+// Reader shapes data read from r, the client side of the stream, as upload
+func (ls *Lease) Reader(r io.Reader) io.Reader {
+	return &shapedReader{r: r, buckets: []*rate.Limiter{ls.peer.upload, ls.l.global.upload}}
+}
+
+// Writer shapes data written to w, the client side of the stream, as download
+func (ls *Lease) Writer(w io.Writer) io.Writer {
+	return &shapedWriter{w: w, buckets: []*rate.Limiter{ls.peer.download, ls.l.global.download}}
+}
+
+func wait(buckets []*rate.Limiter, n int) error {
+	for _, b := range buckets {
+		if err := b.WaitN(context.Background(), n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type shapedReader struct {
+	r       io.Reader
+	buckets []*rate.Limiter
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := s.r.Read(p)
+	if n > 0 {
+		if werr := wait(s.buckets, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+type shapedWriter struct {
+	w       io.Writer
+	buckets []*rate.Limiter
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunkSize)
+		if err := wait(s.buckets, n); err != nil {
+			return written, err
+		}
+
+		m, err := s.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
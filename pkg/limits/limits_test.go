@@ -0,0 +1,117 @@
+package limits_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/pkg/limits"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]limits.Rate{
+		"1024":    1024,
+		"512KiB":  512 << 10,
+		"10MiB/s": 10 << 20,
+		"1.5 MB":  1500000,
+		"2g":      2 << 30,
+		"0":       0,
+	}
+
+	for in, want := range cases {
+		got, err := limits.ParseRate(in)
+		if err != nil {
+			t.Fatalf("ParseRate(%q) failed: %v", in, err)
+		}
+
+		if got != want {
+			t.Errorf("ParseRate(%q) = %d, want %d", in, got, want)
+		}
+	}
+
+	if _, err := limits.ParseRate("fast"); err == nil {
+		t.Error("expected error for invalid rate")
+	}
+}
+
+const (
+	alice = "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp"
+	bob   = "12D3KooWHHzSeKaY8xuZVzkLbKFfvNgPPeKhFBGrMbNzbm5akpqu"
+)
+
+func TestLoad_StreamCaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	data := `
+global:
+  streams: 3
+default:
+  upload: 1MiB
+  streams: 1
+peers:
+  ` + alice + `:
+    streams: 2
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write limits: %v", err)
+	}
+
+	l, err := limits.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	a, _ := peer.Decode(alice)
+	b, _ := peer.Decode(bob)
+
+	for i := range 2 {
+		if _, err := l.Acquire(a); err != nil {
+			t.Fatalf("alice stream %d rejected: %v", i, err)
+		}
+	}
+
+	if _, err := l.Acquire(a); !errors.Is(err, limits.ErrTooManyStreams) {
+		t.Fatalf("expected alice to be over her cap, got %v", err)
+	}
+
+	lease, err := l.Acquire(b)
+	if err != nil {
+		t.Fatalf("bob stream rejected: %v", err)
+	}
+
+	lease.Release()
+	lease.Release()
+
+	if n := l.Streams(b); n != 0 {
+		t.Fatalf("expected released stream to be freed, got %d open", n)
+	}
+
+	if _, err := l.Acquire(b); err != nil {
+		t.Fatalf("bob stream rejected after release: %v", err)
+	}
+
+	// The node is now at its global cap of three streams.
+	if err := os.WriteFile(path, []byte("default:\n  streams: 5\n"), 0o600); err != nil {
+		t.Fatalf("failed to write limits: %v", err)
+	}
+
+	if err := l.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	if _, err := l.Acquire(b); err != nil {
+		t.Fatalf("bob stream rejected after reload: %v", err)
+	}
+}
+
+func TestLoad_InvalidPeer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	if err := os.WriteFile(path, []byte("peers:\n  nope:\n    streams: 1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write limits: %v", err)
+	}
+
+	if _, err := limits.Load(path); err == nil {
+		t.Fatal("expected error for invalid peer ID")
+	}
+}
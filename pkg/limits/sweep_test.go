@@ -0,0 +1,45 @@
+package limits
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSweep_KeepsPeersUntilRefilled(t *testing.T) {
+	l, err := compile(&Config{Default: Limit{Upload: 256}})
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	p := peer.ID("alice")
+
+	ls, err := l.Acquire(p)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	if _, err := io.Copy(io.Discard, ls.Reader(strings.NewReader(strings.Repeat("x", chunkSize)))); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	ls.Release()
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now.Add(sweepInterval))
+	if _, ok := l.peers[p]; !ok {
+		t.Fatal("expected a peer with a drained bucket to be kept")
+	}
+
+	l.sweep(now.Add(3 * sweepInterval))
+	if _, ok := l.peers[p]; ok {
+		t.Fatal("expected an idle peer with full buckets to be dropped")
+	}
+}
@@ -2,14 +2,107 @@ package network
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
+// Tracker follows the streams of an exit node, so the client can tell how
+// loaded each node is
+type Tracker interface {
+	// Opened is called when a tracked Adapter is created
+	Opened()
+	// Transferred is called with the bytes each read or write carried
+	Transferred(n int64)
+	// Closed is called once when the stream closes, with the bytes it carried
+	// in total
+	Closed(total int64)
+}
+
 // Adapter adapts a libp2p Stream to a net.Conn interface
 type Adapter struct {
 	network.Stream
+
+	tracker Tracker
+	mu      sync.Mutex
+	total   int64
+	done    bool
+}
+
+// NewAdapter adapts stream and reports its traffic to tracker until it is
+// closed or reset. A nil tracker is the same as &Adapter{Stream: stream}.
+func NewAdapter(stream network.Stream, tracker Tracker) *Adapter {
+	a := &Adapter{Stream: stream, tracker: tracker}
+	if tracker != nil {
+		tracker.Opened()
+	}
+
+	return a
+}
+
+// Read reads from the stream
+func (a *Adapter) Read(p []byte) (int, error) {
+	n, err := a.Stream.Read(p)
+	a.transferred(n)
+
+	return n, err
+}
+
+// Write writes to the stream
+func (a *Adapter) Write(p []byte) (int, error) {
+	n, err := a.Stream.Write(p)
+	a.transferred(n)
+
+	return n, err
+}
+
+// Close closes the stream
+func (a *Adapter) Close() error {
+	defer a.closed()
+
+	return a.Stream.Close()
+}
+
+// Reset aborts the stream in both directions
+func (a *Adapter) Reset() error {
+	defer a.closed()
+
+	return a.Stream.Reset()
+}
+
+func (a *Adapter) transferred(n int) {
+	if a.tracker == nil || n <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Bytes of a read racing Close are dropped so the tracker's counts
+	// return to zero
+	if a.done {
+		return
+	}
+
+	a.total += int64(n)
+	a.tracker.Transferred(int64(n))
+}
+
+func (a *Adapter) closed() {
+	if a.tracker == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.done {
+		return
+	}
+
+	a.done = true
+	a.tracker.Closed(a.total)
 }
 
 // LocalAddr returns the local network address
@@ -22,6 +115,17 @@ func (a *Adapter) RemoteAddr() net.Addr {
 	return &Addr{s: "libp2p"}
 }
 
+// CloseWrite closes the stream for writing, signalling EOF to the exit node
+// while the response can still be read
+func (a *Adapter) CloseWrite() error {
+	return a.Stream.CloseWrite()
+}
+
+// CloseRead closes the stream for reading while writes can still be sent
+func (a *Adapter) CloseRead() error {
+	return a.Stream.CloseRead()
+}
+
 // SetDeadline sets both read and write deadlines
 func (a *Adapter) SetDeadline(t time.Time) error {
 	return a.Stream.SetDeadline(t)
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Datagrams are framed on the stream as:
+//
+//	length(uint16) addrlen(uint8) addr payload
+//
+// where addr is a host:port string and length covers everything after it.
+const MaxDatagramSize = math.MaxUint16 - 1 - math.MaxUint8
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// DatagramAddr is the host:port endpoint of a relayed datagram. The host may be
+// a domain name, in which case the exit node resolves it.
+type DatagramAddr string
+
+// Network returns the address network type
+func (a DatagramAddr) Network() string {
+	return "udp"
+}
+
+// String returns the string representation of the address
+func (a DatagramAddr) String() string {
+	return string(a)
+}
+
+// WriteDatagram writes one framed datagram to w
+func WriteDatagram(w io.Writer, addr string, payload []byte) error {
+	if len(addr) > math.MaxUint8 {
+		return fmt.Errorf("datagram address too long: %s", addr)
+	}
+
+	if len(payload) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+
+	buf := make([]byte, 0, 3+len(addr)+len(payload))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(1+len(addr)+len(payload)))
+	buf = append(buf, byte(len(addr)))
+	buf = append(buf, addr...)
+	buf = append(buf, payload...)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// ReadDatagram reads one framed datagram from r into p. Payload bytes that do
+// not fit into p are discarded.
+func ReadDatagram(r io.Reader, p []byte) (string, int, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, err
+	}
+
+	size := int(binary.BigEndian.Uint16(hdr[:2]))
+	addrLen := int(hdr[2])
+	if size < 1+addrLen {
+		return "", 0, errors.New("malformed datagram frame")
+	}
+
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+
+	remaining := size - 1 - addrLen
+	n := min(remaining, len(p))
+	if _, err := io.ReadFull(r, p[:n]); err != nil {
+		return "", 0, err
+	}
+
+	if remaining > n {
+		if _, err := io.CopyN(io.Discard, r, int64(remaining-n)); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return string(addr), n, nil
+}
+
+// PacketAdapter adapts a libp2p Stream carrying framed datagrams to a
+// net.PacketConn interface
+type PacketAdapter struct {
+	network.Stream
+
+	mu sync.Mutex
+}
+
+// ReadFrom reads the next datagram relayed by the exit node
+func (a *PacketAdapter) ReadFrom(p []byte) (int, net.Addr, error) {
+	addr, n, err := ReadDatagram(a.Stream, p)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return n, net.UDPAddrFromAddrPort(ap), nil
+	}
+
+	return n, DatagramAddr(addr), nil
+}
+
+// WriteTo asks the exit node to send p to addr
+func (a *PacketAdapter) WriteTo(p []byte, addr net.Addr) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := WriteDatagram(a.Stream, addr.String(), p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// LocalAddr returns the local network address
+func (a *PacketAdapter) LocalAddr() net.Addr {
+	return &Addr{s: "libp2p"}
+}
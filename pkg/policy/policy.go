@@ -0,0 +1,412 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Action is what a rule does with a matching destination
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Destination is an egress target as seen by the node. Domain is empty when the
+// client asked for an IP address directly.
+type Destination struct {
+	Domain string
+	IP     netip.Addr
+	Port   uint16
+}
+
+// Rule matches destinations by CIDR, port range and domain glob. Every
+// non-empty matcher must match for the rule to apply.
+type Rule struct {
+	Action  Action   `yaml:"action"`
+	CIDRs   []string `yaml:"cidrs,omitempty"`
+	Ports   []string `yaml:"ports,omitempty"`
+	Domains []string `yaml:"domains,omitempty"`
+
+	prefixes []netip.Prefix
+	ports    []PortRange
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From, To uint16
+}
+
+// Contains reports whether port is in the range
+func (pr PortRange) Contains(port uint16) bool {
+	return port >= pr.From && port <= pr.To
+}
+
+// compile parses the rule matchers
+func (r *Rule) compile() error {
+	if r.Action != Allow && r.Action != Deny {
+		return fmt.Errorf("invalid rule action: %q", r.Action)
+	}
+
+	r.prefixes = r.prefixes[:0]
+	for _, c := range r.CIDRs {
+		p, err := ParsePrefix(c)
+		if err != nil {
+			return err
+		}
+
+		r.prefixes = append(r.prefixes, p)
+	}
+
+	r.ports = r.ports[:0]
+	for _, s := range r.Ports {
+		pr, err := ParsePortRange(s)
+		if err != nil {
+			return err
+		}
+
+		r.ports = append(r.ports, pr)
+	}
+
+	// Domains may share their backing array with the caller's config, so the
+	// normalized globs go into a fresh slice.
+	domains := make([]string, 0, len(r.Domains))
+	for _, d := range r.Domains {
+		if _, err := path.Match(d, ""); err != nil {
+			return fmt.Errorf("invalid domain glob %q: %w", d, err)
+		}
+
+		domains = append(domains, NormalizeDomain(d))
+	}
+
+	r.Domains = domains
+
+	return nil
+}
+
+// ParsePrefix parses a CIDR, or a single address as a prefix of its full
+// length, into a masked prefix
+func ParsePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		ip, ipErr := netip.ParseAddr(s)
+		if ipErr != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", s, err)
+		}
+
+		p = netip.PrefixFrom(ip, ip.BitLen())
+	}
+
+	return p.Masked(), nil
+}
+
+// ParsePortRange parses a single port such as "443" or a range such as
+// "8000-8100"
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, found := strings.Cut(s, "-")
+
+	lo, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+
+	hi := lo
+	if found {
+		hi, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || hi < lo {
+			return PortRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+
+	return PortRange{From: uint16(lo), To: uint16(hi)}, nil
+}
+
+// NormalizeDomain lowercases a domain name and drops its trailing dot, so
+// names compare equal however they were written
+func NormalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(d), ".")
+}
+
+// Match reports whether the rule applies to d
+func (r *Rule) Match(d Destination) bool {
+	if len(r.ports) > 0 {
+		ok := false
+		for _, pr := range r.ports {
+			if pr.Contains(d.Port) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return r.matchHost(d)
+}
+
+// matchHost reports whether the domain and CIDR matchers of the rule apply to
+// d, regardless of its port
+func (r *Rule) matchHost(d Destination) bool {
+	if len(r.Domains) > 0 {
+		if d.Domain == "" {
+			return false
+		}
+
+		domain := NormalizeDomain(d.Domain)
+
+		ok := false
+		for _, g := range r.Domains {
+			if m, _ := path.Match(g, domain); m {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.prefixes) > 0 {
+		if !d.IP.IsValid() {
+			return false
+		}
+
+		ip := d.IP.Unmap()
+
+		ok := false
+		for _, p := range r.prefixes {
+			if p.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Config is the on-disk policy format. Rules are evaluated in order and the
+// first match wins; unless secure defaults are disabled, the built-in deny
+// rules are evaluated after them, so an explicit allow can open a single
+// private range.
+type Config struct {
+	Default        Action       `yaml:"default"`
+	SecureDefaults *bool        `yaml:"secure_defaults,omitempty"`
+	Rules          []Rule       `yaml:"rules"`
+	Listen         ListenConfig `yaml:"listen"`
+}
+
+// ListenConfig decides which addresses clients may ask the node to listen on
+// for reverse tunnels. Rules match the bind address by CIDR and port; domains
+// never match. Unless the default is set to allow, everything not allowed by
+// a rule is denied.
+type ListenConfig struct {
+	Default Action `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+// secureDefaults blocks loopback, link-local (including cloud metadata
+// endpoints), private, shared address space, benchmarking and multicast
+// destinations. The NAT64 and 6to4 prefixes are blocked as a whole because
+// they embed an IPv4 address that would otherwise bypass the IPv4 ranges.
+func secureDefaults() []Rule {
+	return []Rule{{
+		Action: Deny,
+		CIDRs: []string{
+			"0.0.0.0/8",
+			"127.0.0.0/8",
+			"10.0.0.0/8",
+			"100.64.0.0/10",
+			"169.254.0.0/16",
+			"172.16.0.0/12",
+			"192.0.0.0/24",
+			"192.168.0.0/16",
+			"198.18.0.0/15",
+			"224.0.0.0/4",
+			"240.0.0.0/4",
+			"::/128",
+			"::1/128",
+			"64:ff9b::/96",
+			"64:ff9b:1::/48",
+			"2002::/16",
+			"fc00::/7",
+			"fe80::/10",
+			"ff00::/8",
+		},
+	}}
+}
+
+// Policy evaluates egress destinations on an exit node. It is safe for
+// concurrent use and can be reloaded from its file at runtime.
+type Policy struct {
+	path string
+
+	mu        sync.RWMutex
+	rules     []Rule
+	def       Action
+	listen    []Rule
+	listenDef Action
+}
+
+// Default returns a policy with the secure defaults that allows everything else
+func Default() *Policy {
+	p, err := compile(&Config{})
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// Load reads a policy from a YAML file
+func Load(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Reload re-reads the policy file. On error the current rules are kept.
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return errors.New("policy has no file to reload")
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse policy file: %w", err)
+	}
+
+	np, err := compile(&cfg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rules = np.rules
+	p.def = np.def
+	p.listen = np.listen
+	p.listenDef = np.listenDef
+
+	return nil
+}
+
+func compile(cfg *Config) (*Policy, error) {
+	def := cfg.Default
+	if def == "" {
+		def = Allow
+	}
+
+	if def != Allow && def != Deny {
+		return nil, fmt.Errorf("invalid default action: %q", def)
+	}
+
+	rules := append([]Rule{}, cfg.Rules...)
+	if cfg.SecureDefaults == nil || *cfg.SecureDefaults {
+		rules = append(rules, secureDefaults()...)
+	}
+
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	listenDef := cfg.Listen.Default
+	if listenDef == "" {
+		listenDef = Deny
+	}
+
+	if listenDef != Allow && listenDef != Deny {
+		return nil, fmt.Errorf("invalid listen default action: %q", listenDef)
+	}
+
+	listen := append([]Rule{}, cfg.Listen.Rules...)
+	for i := range listen {
+		if err := listen[i].compile(); err != nil {
+			return nil, fmt.Errorf("listen rule %d: %w", i+1, err)
+		}
+	}
+
+	return &Policy{rules: rules, def: def, listen: listen, listenDef: listenDef}, nil
+}
+
+// Decide returns the action for d
+func (p *Policy) Decide(d Destination) Action {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for i := range p.rules {
+		if p.rules[i].Match(d) {
+			return p.rules[i].Action
+		}
+	}
+
+	return p.def
+}
+
+// Allowed reports whether d may be reached
+func (p *Policy) Allowed(d Destination) bool {
+	return p.Decide(d) == Allow
+}
+
+// Reachable reports whether d may be reached on at least one port, ignoring
+// d.Port. Deny rules limited to some ports are skipped, since other ports stay
+// open, and allow rules limited to some ports count as a match.
+func (p *Policy) Reachable(d Destination) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for i := range p.rules {
+		r := &p.rules[i]
+		if len(r.ports) > 0 && r.Action == Deny {
+			continue
+		}
+
+		if r.matchHost(d) {
+			return r.Action == Allow
+		}
+	}
+
+	return p.def == Allow
+}
+
+// AllowedListen reports whether a client may have the node listen on ip:port
+func (p *Policy) AllowedListen(ip netip.Addr, port uint16) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	d := Destination{IP: ip, Port: port}
+	for i := range p.listen {
+		if p.listen[i].Match(d) {
+			return p.listen[i].Action == Allow
+		}
+	}
+
+	return p.listenDef == Allow
+}
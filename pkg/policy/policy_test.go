@@ -0,0 +1,164 @@
+package policy_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/pkg/policy"
+)
+
+func dst(domain, ip string, port uint16) policy.Destination {
+	return policy.Destination{Domain: domain, IP: netip.MustParseAddr(ip), Port: port}
+}
+
+func TestDefault_BlocksInternalRanges(t *testing.T) {
+	p := policy.Default()
+
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "::1", "fd00:ec2::254", "::ffff:127.0.0.1",
+		"100.64.0.1", "192.0.0.8", "198.18.0.1", "64:ff9b::7f00:1", "2002:7f00:1::1"}
+	for _, ip := range blocked {
+		if p.Allowed(dst("", ip, 80)) {
+			t.Errorf("expected %s to be denied", ip)
+		}
+	}
+
+	if !p.Allowed(dst("example.com", "93.184.216.34", 443)) {
+		t.Error("expected public address to be allowed")
+	}
+}
+
+func TestLoad_RulesBeforeDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	data := `
+default: allow
+rules:
+  - action: allow
+    cidrs: ["10.20.0.0/16"]
+    ports: ["443", "8000-8100"]
+  - action: deny
+    domains: ["*.example.org"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	cases := []struct {
+		d    policy.Destination
+		want bool
+	}{
+		{dst("", "10.20.1.1", 443), true},
+		{dst("", "10.20.1.1", 8050), true},
+		{dst("", "10.20.1.1", 22), false},
+		{dst("", "10.21.1.1", 443), false},
+		{dst("www.EXAMPLE.org.", "93.184.216.34", 443), false},
+		{dst("example.com", "93.184.216.34", 443), true},
+	}
+
+	for _, c := range cases {
+		if got := p.Allowed(c.d); got != c.want {
+			t.Errorf("Allowed(%+v) = %v, want %v", c.d, got, c.want)
+		}
+	}
+}
+
+func TestReload_KeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("default: deny\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("rules:\n  - action: maybe\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Reload(); err == nil {
+		t.Fatal("expected reload of invalid policy to fail")
+	}
+
+	if p.Allowed(dst("", "93.184.216.34", 443)) {
+		t.Fatal("expected previous deny-all policy to remain in effect")
+	}
+}
+
+func TestListen_DeniedByDefault(t *testing.T) {
+	if policy.Default().AllowedListen(netip.MustParseAddr("0.0.0.0"), 8080) {
+		t.Fatal("expected listeners to be denied without rules")
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	data := `
+listen:
+  rules:
+    - action: allow
+      cidrs: ["0.0.0.0/32", "127.0.0.1"]
+      ports: ["8000-8999"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if !p.AllowedListen(netip.MustParseAddr("0.0.0.0"), 8080) {
+		t.Error("expected 0.0.0.0:8080 to be allowed")
+	}
+
+	if p.AllowedListen(netip.MustParseAddr("0.0.0.0"), 22) {
+		t.Error("expected port 22 to be denied")
+	}
+
+	if p.AllowedListen(netip.MustParseAddr("10.0.0.1"), 8080) {
+		t.Error("expected other bind addresses to be denied")
+	}
+}
+
+func TestReachable_IgnoresPorts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	data := `
+default: deny
+rules:
+  - action: deny
+    cidrs: ["203.0.113.0/24"]
+    ports: ["25"]
+  - action: allow
+    cidrs: ["203.0.113.0/24"]
+    ports: ["443"]
+  - action: deny
+    domains: ["*.example.org"]
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if !p.Reachable(dst("mail.example.com", "203.0.113.10", 0)) {
+		t.Error("expected address allowed on some port to be reachable")
+	}
+
+	if p.Reachable(dst("", "198.51.100.1", 0)) {
+		t.Error("expected address outside every allow rule to be unreachable")
+	}
+
+	if p.Reachable(dst("", "127.0.0.1", 0)) {
+		t.Error("expected secure defaults to apply")
+	}
+}
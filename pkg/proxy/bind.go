@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// bindTimeout bounds how long a BIND listener waits for its inbound connection
+const bindTimeout = 2 * time.Minute
+
+// A BIND request asks the node to accept one inbound connection from the
+// address in the request, for protocols such as active FTP where the server
+// connects back. The node answers twice: first with the address it listens
+// on, then with the address of the peer that connected, after which the
+// stream carries that connection.
+
+// bind serves a CommandBind request. Only connections from the addresses the
+// expected peer resolves to, and that the policy lets the node reach, are
+// accepted.
+func (h *Server) bind(client net.Conn, remotePeer peer.ID, c codec, req *Request) {
+	host, _, err := net.SplitHostPort(req.ProxyAddress)
+	if err != nil {
+		h.sendError(client, c, NewError(CodeGeneralFailure, fmt.Sprintf("invalid bind address %q", req.ProxyAddress)))
+		return
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil && ip.IsUnspecified() {
+		h.sendError(client, c, NewError(CodeNotAllowed, "BIND needs the address of the expected peer"))
+		return
+	}
+
+	addrs, err := h.resolve(context.Background(), req.ProxyAddress)
+	if err != nil {
+		logging.Logger.Warn("Refusing bind request", "from", remotePeer, "addr", req.ProxyAddress, "error", err)
+		h.sendError(client, c, err)
+
+		return
+	}
+
+	sl, err := h.admit(client, c, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	_ = client.SetDeadline(time.Time{})
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP(addrs[0].Addr()).AsSlice()})
+	if err != nil {
+		logging.Logger.Error("Failed to open bind listener", "error", err)
+		h.sendError(client, c, err)
+
+		return
+	}
+
+	defer ln.Close()
+
+	if err := c.writeResponse(client, &ProxyResponse{Status: StatusOK, Address: ln.Addr().String()}); err != nil {
+		logging.Logger.Error("Failed to send success response", "error", err)
+		return
+	}
+
+	logging.Logger.Info("Waiting for bind connection", "addr", ln.Addr(), "peer", req.ProxyAddress)
+
+	// A client that goes away while the node waits closes the listener, so
+	// neither it nor the stream slot is held until the bind timeout
+	up := watchRead(client, func() { _ = ln.Close() })
+
+	conn, err := acceptFrom(ln, addrs)
+	if err != nil {
+		if up.failed() {
+			logging.Logger.Info("Client left before the bind connection", "addr", ln.Addr())
+			return
+		}
+
+		logging.Logger.Warn("No bind connection", "addr", ln.Addr(), "error", err)
+		h.sendError(client, c, err)
+
+		return
+	}
+
+	defer conn.Close()
+
+	_ = ln.Close()
+
+	if err := c.writeResponse(client, &ProxyResponse{Status: StatusOK, Address: conn.RemoteAddr().String()}); err != nil {
+		logging.Logger.Error("Failed to send success response", "error", err)
+		return
+	}
+
+	logging.Logger.Info("Starting data forwarding", "addr", conn.RemoteAddr())
+
+	if err := splice(client, conn, sl.reader(up), sl.writer(client)); err != nil {
+		logging.Logger.Error("Forwarding error", "error", err)
+	}
+}
+
+// pendingRead reads from a connection in the background while the node waits
+// on something else, and replays what it read to the first Read call, so data
+// the client sends early is not lost
+type pendingRead struct {
+	r    io.Reader
+	done chan struct{}
+	buf  []byte
+	err  error
+}
+
+// watchRead starts a read on r and calls cancel if it fails, which is how a
+// closed or reset stream shows up
+func watchRead(r io.Reader, cancel func()) *pendingRead {
+	p := &pendingRead{r: r, done: make(chan struct{})}
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		p.buf, p.err = buf[:n], err
+
+		close(p.done)
+
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	return p
+}
+
+// failed reports whether the background read has already failed
+func (p *pendingRead) failed() bool {
+	select {
+	case <-p.done:
+		return p.err != nil
+	default:
+		return false
+	}
+}
+
+func (p *pendingRead) Read(b []byte) (int, error) {
+	<-p.done
+
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+
+		return n, nil
+	}
+
+	if p.err != nil {
+		err := p.err
+		p.err = nil
+
+		return 0, err
+	}
+
+	return p.r.Read(b)
+}
+
+// localIP returns the address the node would use to reach dst, so the bind
+// listener is on the interface the peer can connect to. Connecting a UDP
+// socket only picks the route; no packet is sent.
+func localIP(dst netip.Addr) netip.Addr {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.IPv4Unspecified()
+	}
+
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+}
+
+// acceptFrom returns the first connection accepted on ln from one of the
+// allowed addresses, whatever its port. Others are dropped.
+func acceptFrom(ln *net.TCPListener, allowed []netip.AddrPort) (net.Conn, error) {
+	_ = ln.SetDeadline(time.Now().Add(bindTimeout))
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				return nil, NewError(CodeTimeout, "no inbound connection before the bind timeout")
+			}
+
+			return nil, err
+		}
+
+		from := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		for _, a := range allowed {
+			if a.Addr() == from {
+				return conn, nil
+			}
+		}
+
+		logging.Logger.Warn("Dropping bind connection from unexpected peer", "from", conn.RemoteAddr())
+		_ = conn.Close()
+	}
+}
+
+// Binding is a listener an exit node opened for a BIND request
+type Binding struct {
+	PeerID peer.ID
+	// Addr is the address the node listens on
+	Addr string
+
+	stream  network.Stream
+	tracker pkgnetwork.Tracker
+}
+
+// Accept waits for the inbound connection and returns it with the address of
+// its remote end
+func (b *Binding) Accept() (net.Conn, string, error) {
+	resp, err := binaryCodec{}.readResponse(b.stream)
+	if err != nil {
+		_ = b.stream.Reset()
+		return nil, "", &NodeError{PeerID: b.PeerID, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if err := resp.Err(); err != nil {
+		_ = b.stream.Close()
+		return nil, "", err
+	}
+
+	return pkgnetwork.NewAdapter(b.stream, b.tracker), resp.Address, nil
+}
+
+// Close gives up on the inbound connection, or closes it once accepted
+func (b *Binding) Close() error {
+	return b.stream.Close()
+}
+
+// Bind asks a specific exit node to accept one inbound connection from addr
+func (d *Client) Bind(ctx context.Context, peerID peer.ID, addr string) (*Binding, error) {
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "ProxyProtocolID"), peerID, ProxyProtocolV2ID)
+	if err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to open stream: %w", err)}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	c := binaryCodec{}
+
+	if err := c.writeRequest(stream, &Request{Command: CommandBind, ProxyAddress: addr}); err != nil {
+		_ = stream.Reset()
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	resp, err := c.readResponse(stream)
+	if err != nil {
+		_ = stream.Reset()
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if err := resp.Err(); err != nil {
+		_ = stream.Close()
+
+		if IsNodeError(err) {
+			return nil, &NodeError{PeerID: peerID, Err: err}
+		}
+
+		return nil, err
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	return &Binding{PeerID: peerID, Addr: resp.Address, stream: stream, tracker: d.load(peerID)}, nil
+}
+
+// BindByStrategy opens a BIND listener on an exit node chosen by the pool's
+// current strategy, failing over to other nodes like DialByStrategy
+func (d *Client) BindByStrategy(ctx context.Context, addr string) (*Binding, error) {
+	return d.BindRoute(ctx, Route{}, addr)
+}
+
+// BindRoute opens a BIND listener on an exit node picked for route, failing
+// over to other nodes like DialRoute
+func (d *Client) BindRoute(ctx context.Context, route Route, addr string) (*Binding, error) {
+	var b *Binding
+
+	err := d.failoverRoute(ctx, "bind", route, func(c *Connection) error {
+		var err error
+		b, err = d.Bind(ctx, c.PeerID, addr)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
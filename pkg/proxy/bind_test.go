@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchRead_ReplaysEarlyData(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cancelled := make(chan struct{})
+	p := watchRead(a, func() { close(cancelled) })
+
+	go func() {
+		_, _ = b.Write([]byte("early"))
+		_, _ = b.Write([]byte(" data"))
+		_ = b.Close()
+	}()
+
+	got, err := io.ReadAll(p)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+
+	if string(got) != "early data" {
+		t.Fatalf("expected early data to be replayed, got %q", got)
+	}
+
+	select {
+	case <-cancelled:
+		t.Fatal("expected data to not cancel the wait")
+	default:
+	}
+}
+
+func TestWatchRead_CancelsOnClose(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cancelled := make(chan struct{})
+	p := watchRead(a, func() { close(cancelled) })
+
+	_ = b.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected a closed connection to cancel the wait")
+	}
+
+	if !p.failed() {
+		t.Fatal("expected the watch to report the failed read")
+	}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"math"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// BreakerState is the state of the circuit breaker of a node
+type BreakerState int
+
+const (
+	// BreakerClosed lets requests through; failures are being counted
+	BreakerClosed BreakerState = iota
+	// BreakerOpen ejects the node from every strategy until the ejection
+	// duration ends
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial request through after an
+	// ejection. Its outcome closes the breaker on success or reopens it on
+	// failure; until then the node stays out of selection.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerConfig tunes the circuit breakers of a pool
+type BreakerConfig struct {
+	// Failures is how many consecutive failed probes or dials open the
+	// breaker of a node. Zero disables the breakers.
+	Failures int
+	// Ejection is how long an open breaker keeps its node out
+	Ejection time.Duration
+	// MaxEjected is the largest share of the pool, from 0 to 1, that may be
+	// ejected at once, rounded up so a small pool can still eject one node.
+	// Breakers past it stay closed. Zero disables ejection.
+	MaxEjected float64
+}
+
+// DefaultBreaker is the breaker configuration of a new pool
+var DefaultBreaker = BreakerConfig{
+	Failures:   3,
+	Ejection:   30 * time.Second,
+	MaxEjected: 0.5,
+}
+
+// breaker is the circuit breaker of a connection. The open state turns into
+// half-open lazily once until has passed, so selecting nodes needs no write.
+type breaker struct {
+	state    BreakerState
+	failures int
+	until    time.Time
+	// trial is when the trial request of a half-open breaker was handed out,
+	// or zero when none is in flight
+	trial time.Time
+}
+
+// current returns the state at now
+func (b *breaker) current(now time.Time) BreakerState {
+	if b.state == BreakerOpen && !now.Before(b.until) {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+// ejected reports whether the node is out of selection at now
+func (b *breaker) ejected(now time.Time) bool {
+	return b.current(now) == BreakerOpen
+}
+
+// testing reports whether the trial request of a half-open breaker is in
+// flight at now. A trial that never reports back expires after timeout, so
+// the node is not kept out for good.
+func (b *breaker) testing(now time.Time, timeout time.Duration) bool {
+	return b.current(now) == BreakerHalfOpen && !b.trial.IsZero() && now.Before(b.trial.Add(timeout))
+}
+
+// claim hands the request about to go through the node its trial when the
+// breaker is half-open. It reports false when another request already holds
+// it. The caller must hold p.mu for writing.
+func (p *Pool) claim(conn *Connection) bool {
+	now := time.Now()
+	b := &conn.breaker
+
+	if b.current(now) != BreakerHalfOpen {
+		return true
+	}
+
+	if b.testing(now, p.breaker.Ejection) {
+		return false
+	}
+
+	b.trial = now
+
+	return true
+}
+
+// Report feeds the outcome of a probe or request through peerID to its
+// circuit breaker. Only node-side errors count as failures, since an error
+// reaching the destination means the node itself works.
+func (p *Pool) Report(peerID peer.ID, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.report(peerID, err == nil || !IsNodeError(err))
+}
+
+// report updates the breaker of peerID. The caller must hold p.mu.
+func (p *Pool) report(peerID peer.ID, ok bool) {
+	if p.breaker.Failures <= 0 {
+		return
+	}
+
+	var conn *Connection
+	for _, c := range p.conns {
+		if c.PeerID == peerID {
+			conn = c
+			break
+		}
+	}
+
+	if conn == nil {
+		return
+	}
+
+	now := time.Now()
+	b := &conn.breaker
+
+	switch b.current(now) {
+	case BreakerOpen:
+		// Outcomes during the ejection, such as probes, are ignored; the
+		// first one after it decides
+	case BreakerHalfOpen:
+		b.trial = time.Time{}
+
+		if ok {
+			b.state, b.failures = BreakerClosed, 0
+
+			logging.Logger.Info("Exit node restored", "node", peerID)
+
+			return
+		}
+
+		b.state, b.until = BreakerOpen, now.Add(p.breaker.Ejection)
+
+		logging.Logger.Warn("Exit node still failing; ejecting it again", "node", peerID, "for", p.breaker.Ejection)
+	default:
+		if ok {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures < p.breaker.Failures {
+			return
+		}
+
+		if !p.canEject(now) {
+			logging.Logger.Warn("Exit node failing but too many nodes are ejected", "node", peerID, "failures", b.failures)
+			return
+		}
+
+		b.state, b.until = BreakerOpen, now.Add(p.breaker.Ejection)
+
+		logging.Logger.Warn("Ejecting exit node", "node", peerID, "failures", b.failures, "for", p.breaker.Ejection)
+	}
+}
+
+// canEject reports whether one more node may be ejected without passing the
+// MaxEjected share. Nodes in a half-open trial are out of rotation too and
+// count as ejected. The share is rounded up with a minimum of one node, so a
+// pool of one or two nodes can still eject one. The caller must hold p.mu.
+func (p *Pool) canEject(now time.Time) bool {
+	if p.breaker.MaxEjected <= 0 {
+		return false
+	}
+
+	ejected := 0
+	for _, c := range p.conns {
+		if c.breaker.ejected(now) || c.breaker.testing(now, p.breaker.Ejection) {
+			ejected++
+		}
+	}
+
+	limit := max(1, int(math.Ceil(p.breaker.MaxEjected*float64(len(p.conns)))))
+
+	return ejected+1 <= limit
+}
+
+// SetBreaker replaces the breaker configuration of the pool
+func (p *Pool) SetBreaker(cfg BreakerConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.breaker = cfg
+}
+
+// State returns the breaker state of peerID
+func (p *Pool) State(peerID peer.ID) BreakerState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, conn := range p.conns {
+		if conn.PeerID == peerID {
+			return conn.breaker.current(time.Now())
+		}
+	}
+
+	return BreakerClosed
+}
@@ -2,10 +2,11 @@ package proxy
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/henrybarreto/bethrou/pkg/config"
@@ -19,15 +20,96 @@ import (
 
 // Connection represents a connection to a proxy node
 type Connection struct {
-	PeerID  peer.ID
-	Addr    string
-	Latency time.Duration
+	PeerID peer.ID
+	Addr   string
+	// Latency is the moving average round trip of the node's health probes
+	Latency  time.Duration
+	Labels   map[string]string
+	Weight   int
+	Priority int
+
+	stats    stats
+	breaker  breaker
+	streams  atomic.Int64
+	inFlight atomic.Int64
 }
 
+// Healthy reports whether the node passed its last health check. Nodes not
+// probed yet are healthy.
+func (c *Connection) Healthy() bool {
+	return !c.stats.failed
+}
+
+// Streams returns the number of proxied streams open through the node
+func (c *Connection) Streams() int64 {
+	return c.streams.Load()
+}
+
+// InFlight returns the bytes carried so far by the node's open streams
+func (c *Connection) InFlight() int64 {
+	return c.inFlight.Load()
+}
+
+// load tracks the streams open through a set of nodes, such as the nodes of
+// a circuit
+type load []*Connection
+
+func (l load) Opened() {
+	for _, c := range l {
+		c.streams.Add(1)
+	}
+}
+
+func (l load) Transferred(n int64) {
+	for _, c := range l {
+		c.inFlight.Add(n)
+	}
+}
+
+func (l load) Closed(total int64) {
+	for _, c := range l {
+		c.streams.Add(-1)
+		c.inFlight.Add(-total)
+	}
+}
+
+// load returns a tracker counting a stream against the pool connections of
+// ids, or nil when none of them is in the pool
+func (d *Client) load(ids ...peer.ID) pkgnetwork.Tracker {
+	var l load
+	for _, id := range ids {
+		if c := d.Pool.Get(id); c != nil {
+			l = append(l, c)
+		}
+	}
+
+	if len(l) == 0 {
+		return nil
+	}
+
+	return l
+}
+
+// DefaultAttempts is how many nodes a request is tried on when the client has
+// no attempt budget set
+const DefaultAttempts = 3
+
 // Client is the client-side proxy dialer that connects to exit nodes
 type Client struct {
 	Host host.Host
 	Pool *Pool
+	// Attempts is how many different nodes the ByStrategy methods try before
+	// giving up. Only node-side failures move on to the next node.
+	Attempts int
+	// Hops is the number of nodes DialByStrategy chains into a circuit. Zero
+	// and one dial the exit directly.
+	Hops int
+	// Path fixes the nodes of every circuit, entry first and exit last. It
+	// takes precedence over Hops.
+	Path []peer.ID
+
+	reverse     reverseTunnels
+	reverseOnce sync.Once
 }
 
 // NewClient creates a new client-side proxy dialer
@@ -52,31 +134,44 @@ func (d *Client) Ping(ctx context.Context, conn *Connection) (time.Duration, err
 	return time.Since(start), nil
 }
 
-// Dial establishes a proxy connection through a specific exit node
+// Dial establishes a proxy connection through a specific exit node. The newest
+// proxy protocol the node supports is negotiated on the stream. The outcome
+// feeds the node's circuit breaker unless ctx ended first.
 func (d *Client) Dial(ctx context.Context, peerID peer.ID, addr string) (net.Conn, error) {
-	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "ProxyProtocolID"), peerID, ProxyProtocolID)
+	conn, err := d.dial(ctx, peerID, addr)
+	if ctx.Err() == nil {
+		d.Pool.Report(peerID, err)
+	}
+
+	return conn, err
+}
+
+func (d *Client) dial(ctx context.Context, peerID peer.ID, addr string) (net.Conn, error) {
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "ProxyProtocolID"), peerID, ProxyProtocols...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stream: %w", err)
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to open stream: %w", err)}
 	}
 
-	req := Request{ProxyAddress: addr}
-	if err := json.NewEncoder(stream).Encode(req); err != nil {
+	c := codecFor(stream.Protocol())
+
+	req := &Request{Command: CommandConnect, ProxyAddress: addr}
+	if err := c.writeRequest(stream, req); err != nil {
 		_ = stream.Close()
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to send request: %w", err)}
 	}
 
-	var resp ProxyResponse
-	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+	resp, err := c.readResponse(stream)
+	if err != nil {
 		_ = stream.Close()
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to read response: %w", err)}
 	}
 
-	if resp.Status != "ok" {
+	if err := resp.Err(); err != nil {
 		_ = stream.Close()
-		return nil, fmt.Errorf("proxy failed: %s", resp.Message)
+		return nil, err
 	}
 
-	return &pkgnetwork.Adapter{Stream: stream}, nil
+	return pkgnetwork.NewAdapter(stream, d.load(peerID)), nil
 }
 
 // dialConnection is a convenience method that dials using a Connection struct
@@ -115,18 +210,141 @@ func (d *Client) DialRoundRobin(ctx context.Context, addr string) (net.Conn, err
 	return d.dialConnection(ctx, conn, addr)
 }
 
-// DialByStrategy dials an exit node based on the pool's current strategy.
+// DialByStrategy dials through an exit node picked by the pool's current
+// strategy, or through a circuit when Hops or Path are set. When a node fails,
+// other nodes are tried within the attempt budget; errors reaching the
+// destination are returned straight away.
 func (d *Client) DialByStrategy(ctx context.Context, addr string) (net.Conn, error) {
-	switch d.Pool.GetStrategy() {
-	case RandomStrategy:
-		return d.DialRandom(ctx, addr)
-	case FastestStrategy:
-		return d.DialFastest(ctx, addr)
-	case RoundRobinStrategy:
-		return d.DialRoundRobin(ctx, addr)
+	return d.DialRoute(ctx, Route{}, addr)
+}
+
+func (d *Client) attempts() int {
+	if d.Attempts <= 0 {
+		return DefaultAttempts
+	}
+
+	return d.Attempts
+}
+
+// Route narrows the exit nodes a single request may use. The zero Route uses
+// every node with the pool's current strategy.
+type Route struct {
+	// Strategy replaces the pool's strategy when set
+	Strategy PoolStrategy
+	// Selector restricts the request to nodes whose labels match
+	Selector Selector
+	// Key identifies the request for the sticky strategy, such as its
+	// destination host
+	Key string
+}
+
+// strategy returns the strategy of the route, or the pool's
+func (r Route) strategy(p *Pool) PoolStrategy {
+	if r.Strategy != "" {
+		return r.Strategy
+	}
+
+	return p.GetStrategy()
+}
+
+// exclude returns the nodes outside the route's selector, or an error when no
+// node is left
+func (r Route) exclude(p *Pool) (map[peer.ID]bool, error) {
+	excluded := make(map[peer.ID]bool)
+	if len(r.Selector) == 0 {
+		return excluded, nil
+	}
+
+	matching := p.Match(r.Selector)
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no exit nodes match %s", r.Selector)
+	}
+
+	for _, c := range p.All() {
+		excluded[c.PeerID] = true
+	}
+
+	for _, c := range matching {
+		delete(excluded, c.PeerID)
+	}
+
+	return excluded, nil
+}
+
+// DialRoute is DialByStrategy with the exit node picked within route. When
+// circuits are enabled the route applies to the exit node of the circuit,
+// unless Path fixes every node.
+func (d *Client) DialRoute(ctx context.Context, route Route, addr string) (net.Conn, error) {
+	if d.circuit() {
+		return d.dialCircuit(ctx, route, addr)
+	}
+
+	var conn net.Conn
+
+	err := d.failoverRoute(ctx, "dial", route, func(c *Connection) error {
+		var err error
+		conn, err = d.dialConnection(ctx, c, addr)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// failover runs fn on nodes picked by the pool's current strategy until it
+// succeeds, fails with an error that is not node-side or the attempt budget is
+// used up. Each node is tried at most once.
+func (d *Client) failover(ctx context.Context, op string, fn func(c *Connection) error) error {
+	return d.failoverRoute(ctx, op, Route{}, fn)
+}
+
+// failoverRoute is failover restricted to the nodes and strategy of route
+func (d *Client) failoverRoute(ctx context.Context, op string, route Route, fn func(c *Connection) error) error {
+	strategy := route.strategy(d.Pool)
+	switch strategy {
+	case RandomStrategy, FastestStrategy, RoundRobinStrategy, StickyStrategy, WeightedStrategy,
+		LeastConnectionsStrategy, LeastBytesStrategy:
 	default:
-		return nil, errors.New("unknown dialing strategy")
+		return errors.New("unknown dialing strategy")
+	}
+
+	// Nodes outside the selector are treated as already tried
+	tried, err := route.exclude(d.Pool)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for range d.attempts() {
+		c := d.Pool.SelectKey(strategy, route.Key, tried)
+		if c == nil {
+			break
+		}
+
+		tried[c.PeerID] = true
+
+		err := fn(c)
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+
+		if !IsNodeError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		logging.Logger.Warn("Exit node failed; trying another", "op", op, "node", c.PeerID, "error", err)
 	}
+
+	if lastErr == nil {
+		return errors.New("no exit nodes available")
+	}
+
+	return lastErr
 }
 
 func (p *Client) connect(ctx context.Context, node config.NodeConfig) error {
@@ -170,7 +388,7 @@ func (p *Client) connect(ctx context.Context, node config.NodeConfig) error {
 
 		logging.Logger.Info("Connected to node via relay", "node", node.ID, "relay", relayInfo.ID)
 
-		p.Pool.Add(nodeInfo.ID, circuitAddr.String())
+		p.Pool.Add(nodeInfo.ID, circuitAddr.String(), node.Labels, node.Weight, node.Priority)
 
 		return nil
 	}
@@ -198,7 +416,7 @@ func (p *Client) connect(ctx context.Context, node config.NodeConfig) error {
 			continue
 		}
 
-		p.Pool.Add(nodeInfo.ID, addr)
+		p.Pool.Add(nodeInfo.ID, addr, node.Labels, node.Weight, node.Priority)
 
 		connected = true
 		break
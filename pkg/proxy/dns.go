@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// resolveTimeout bounds a single lookup on the node
+const resolveTimeout = 5 * time.Second
+
+// DNS lookups use the 2.0.0 frame format. The request op selects the address
+// family (0 for both, 4 or 6) and carries the name in fieldAddress; the
+// response carries one fieldIP per address.
+const (
+	lookupIP  byte = 0
+	lookupIP4 byte = 4
+	lookupIP6 byte = 6
+)
+
+func lookupNetwork(op byte) (string, error) {
+	switch op {
+	case lookupIP:
+		return "ip", nil
+	case lookupIP4:
+		return "ip4", nil
+	case lookupIP6:
+		return "ip6", nil
+	default:
+		return "", fmt.Errorf("unsupported lookup family %d", op)
+	}
+}
+
+// handleDNS resolves a name with the node's resolver. Lookups take a stream
+// slot like any other request, and only addresses the policy lets the node
+// reach are returned.
+func (h *Server) handleDNS(s network.Stream) {
+	defer s.Close()
+
+	remotePeer := s.Conn().RemotePeer()
+	c := binaryCodec{}
+
+	sl, err := h.admit(s, c, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	r, w := sl.reader(s), sl.writer(s)
+
+	f, err := readFrame(r)
+	if err != nil {
+		logging.Logger.Error("Failed to decode DNS request", "error", err)
+		h.sendError(w, c, err)
+
+		return
+	}
+
+	name := f.getString(fieldAddress)
+
+	nw, err := lookupNetwork(f.op)
+	if err != nil {
+		h.sendError(w, c, NewError(CodeGeneralFailure, err.Error()))
+		return
+	}
+
+	logging.Logger.Debug("Resolving", "name", name, "network", nw, "from", remotePeer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, nw, name)
+	if err != nil {
+		logging.Logger.Warn("Failed to resolve", "name", name, "error", err)
+		h.sendError(w, c, err)
+
+		return
+	}
+
+	resp := &frame{op: statusOK}
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if h.policy.Reachable(policy.Destination{Domain: name, IP: ip}) {
+			resp.set(fieldIP, ip.AsSlice())
+		}
+	}
+
+	if len(resp.fields) == 0 {
+		logging.Logger.Warn("Refusing lookup denied by policy", "name", name, "from", remotePeer)
+		h.sendError(w, c, NewError(CodeNotAllowed, fmt.Sprintf("%s is not allowed by node policy", name)))
+
+		return
+	}
+
+	if err := writeFrame(w, resp); err != nil {
+		logging.Logger.Error("Failed to send DNS response", "error", err)
+	}
+}
+
+// Resolve looks up the A and AAAA records of name using the resolver of a
+// specific exit node
+func (d *Client) Resolve(ctx context.Context, peerID peer.ID, name string) ([]netip.Addr, error) {
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "DNSProtocolID"), peerID, DNSProtocolID)
+	if err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to open stream: %w", err)}
+	}
+
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	req := &frame{op: lookupIP}
+	req.set(fieldAddress, []byte(name))
+
+	if err := writeFrame(stream, req); err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	resp, err := readFrame(stream)
+	if err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if resp.op != statusOK {
+		return nil, NewError(ErrorCode(resp.op), resp.getString(fieldMessage))
+	}
+
+	var ips []netip.Addr
+	for _, fl := range resp.fields {
+		if fl.tag != fieldIP {
+			continue
+		}
+
+		if ip, ok := netip.AddrFromSlice(fl.value); ok {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, NewError(CodeDNSFailure, "no addresses for "+name)
+	}
+
+	return ips, nil
+}
+
+// ResolveByStrategy resolves name through an exit node chosen by the pool's
+// current strategy, failing over to other nodes like DialByStrategy
+func (d *Client) ResolveByStrategy(ctx context.Context, name string) ([]netip.Addr, error) {
+	var ips []netip.Addr
+
+	err := d.failover(ctx, "resolve", func(c *Connection) error {
+		var err error
+		ips, err = d.Resolve(ctx, c.PeerID, name)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// dnsPeers links a client host to a node serving with p
+func dnsPeers(t *testing.T, p *policy.Policy) (*Client, *Server) {
+	t.Helper()
+
+	logging.Setup(nil)
+
+	mn, err := mocknet.FullMeshConnected(2)
+	if err != nil {
+		t.Fatalf("failed to create mock network: %v", err)
+	}
+
+	t.Cleanup(func() { _ = mn.Close() })
+
+	hosts := mn.Hosts()
+
+	return NewClient(hosts[0], NewPool(RandomStrategy)), NewServer(hosts[1], ServerConfig{Policy: p})
+}
+
+func TestResolve_FiltersByPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("rules:\n  - action: allow\n    cidrs: [\"127.0.0.0/8\"]\n"), 0o600); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+
+	c, s := dnsPeers(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := c.Resolve(ctx, s.host.ID(), "localhost")
+	if err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+
+	for _, ip := range ips {
+		if !ip.IsLoopback() || !ip.Is4() {
+			t.Errorf("expected only IPv4 loopback addresses, got %s", ip)
+		}
+	}
+}
+
+func TestResolve_DeniedByPolicy(t *testing.T) {
+	c, s := dnsPeers(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.Resolve(ctx, s.host.ID(), "localhost")
+
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Code != CodeNotAllowed {
+		t.Fatalf("expected CodeNotAllowed, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrorCode classifies why a node could not serve a proxy request. Codes are
+// carried in the handshake response so clients can tell destination failures
+// apart from node failures.
+type ErrorCode uint8
+
+const (
+	CodeGeneralFailure ErrorCode = iota + 1
+	CodeConnectionRefused
+	CodeHostUnreachable
+	CodeNetworkUnreachable
+	CodeTimeout
+	CodeNotAllowed
+	CodeDNSFailure
+	CodeOverloaded
+	CodeQuotaExceeded
+	CodeHopUnreachable
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeGeneralFailure:     "general_failure",
+	CodeConnectionRefused:  "connection_refused",
+	CodeHostUnreachable:    "host_unreachable",
+	CodeNetworkUnreachable: "network_unreachable",
+	CodeTimeout:            "timeout",
+	CodeNotAllowed:         "not_allowed",
+	CodeDNSFailure:         "dns_failure",
+	CodeOverloaded:         "overloaded",
+	CodeQuotaExceeded:      "quota_exceeded",
+	CodeHopUnreachable:     "hop_unreachable",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+
+	return codeNames[CodeGeneralFailure]
+}
+
+// MarshalText encodes the code by name for the 1.0.0 JSON handshake
+func (c ErrorCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText decodes a code name. Unknown names map to CodeGeneralFailure.
+func (c *ErrorCode) UnmarshalText(b []byte) error {
+	for code, name := range codeNames {
+		if name == string(b) {
+			*c = code
+			return nil
+		}
+	}
+
+	*c = CodeGeneralFailure
+
+	return nil
+}
+
+// Error is a failure reported by a node in its handshake response
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "proxy failed: " + e.Code.String() + ": " + e.Message
+}
+
+// NewError creates an Error with the given code and message
+func NewError(code ErrorCode, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// NodeError is a failure of the exit node itself, such as a stream that could
+// not be opened or a broken handshake, as opposed to a failure of the node to
+// reach the destination. Another node may succeed where this one failed.
+type NodeError struct {
+	PeerID peer.ID
+	Err    error
+}
+
+func (e *NodeError) Error() string {
+	return "node " + e.PeerID.String() + ": " + e.Err.Error()
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// IsNodeError reports whether err is a node-side failure worth retrying on
+// another node. Besides NodeError, this includes nodes refusing a request
+// because they are overloaded, the peer is over its quota there or the next
+// node of a circuit could not be reached.
+func IsNodeError(err error) bool {
+	var nerr *NodeError
+	if errors.As(err, &nerr) {
+		return true
+	}
+
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr.Code == CodeOverloaded || perr.Code == CodeQuotaExceeded || perr.Code == CodeHopUnreachable
+	}
+
+	return false
+}
+
+// Classify maps a dial or resolve error to the closest ErrorCode
+func Classify(err error) ErrorCode {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr.Code
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return CodeTimeout
+		}
+
+		return CodeDNSFailure
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CodeConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return CodeHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return CodeNetworkUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		return CodeTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CodeTimeout
+	}
+
+	return CodeGeneralFailure
+}
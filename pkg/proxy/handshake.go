@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// The 2.0.0 handshake is a sequence of length-prefixed binary frames:
+//
+//	frame := length(uint16) version(uint8) op(uint8) field*
+//	field := tag(uint8) length(uint16) value
+//
+// For requests op is the Command, for responses it is zero on success or the
+// ErrorCode of the failure. Fields with unknown tags are skipped, so new
+// options can be added without another protocol bump.
+const handshakeVersion byte = 2
+
+const (
+	fieldAddress  byte = 0x01
+	fieldMessage  byte = 0x02
+	fieldIP       byte = 0x03
+	fieldPeer     byte = 0x04
+	fieldPeerAddr byte = 0x05
+	fieldTunnel   byte = 0x06
+)
+
+const statusOK byte = 0x00
+
+var (
+	ErrFrameTooLarge  = errors.New("handshake frame too large")
+	ErrMalformedFrame = errors.New("malformed handshake frame")
+)
+
+type field struct {
+	tag   byte
+	value []byte
+}
+
+type frame struct {
+	version byte
+	op      byte
+	fields  []field
+}
+
+// set appends a field to the frame. Empty values are omitted.
+func (f *frame) set(tag byte, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+
+	f.fields = append(f.fields, field{tag: tag, value: value})
+}
+
+// get returns the value of the first field with the given tag.
+func (f *frame) get(tag byte) ([]byte, bool) {
+	for _, fl := range f.fields {
+		if fl.tag == tag {
+			return fl.value, true
+		}
+	}
+
+	return nil, false
+}
+
+// getAll returns the values of every field with the given tag.
+func (f *frame) getAll(tag byte) [][]byte {
+	var values [][]byte
+	for _, fl := range f.fields {
+		if fl.tag == tag {
+			values = append(values, fl.value)
+		}
+	}
+
+	return values
+}
+
+func (f *frame) getString(tag byte) string {
+	v, _ := f.get(tag)
+
+	return string(v)
+}
+
+func writeFrame(w io.Writer, f *frame) error {
+	buf := make([]byte, 4, 64)
+	buf[2] = handshakeVersion
+	buf[3] = f.op
+
+	for _, fl := range f.fields {
+		if len(fl.value) > math.MaxUint16 {
+			return ErrFrameTooLarge
+		}
+
+		buf = append(buf, fl.tag)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(fl.value)))
+		buf = append(buf, fl.value...)
+	}
+
+	if len(buf)-2 > math.MaxUint16 {
+		return ErrFrameTooLarge
+	}
+
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint16(hdr[:])
+	if size < 2 {
+		return nil, ErrMalformedFrame
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if payload[0] < handshakeVersion {
+		return nil, fmt.Errorf("unsupported handshake version %d", payload[0])
+	}
+
+	f := &frame{version: payload[0], op: payload[1]}
+
+	rest := payload[2:]
+	for len(rest) > 0 {
+		if len(rest) < 3 {
+			return nil, ErrMalformedFrame
+		}
+
+		tag, n := rest[0], int(binary.BigEndian.Uint16(rest[1:3]))
+		rest = rest[3:]
+
+		if n > len(rest) {
+			return nil, ErrMalformedFrame
+		}
+
+		f.fields = append(f.fields, field{tag: tag, value: rest[:n]})
+		rest = rest[n:]
+	}
+
+	return f, nil
+}
+
+// codec encodes and decodes the proxy handshake for one protocol version.
+type codec interface {
+	writeRequest(w io.Writer, req *Request) error
+	readRequest(r io.Reader) (*Request, error)
+	writeResponse(w io.Writer, resp *ProxyResponse) error
+	readResponse(r io.Reader) (*ProxyResponse, error)
+}
+
+// codecFor returns the handshake codec for a negotiated protocol ID.
+func codecFor(id protocol.ID) codec {
+	if id == ProxyProtocolV2ID {
+		return binaryCodec{}
+	}
+
+	return jsonCodec{}
+}
+
+// jsonCodec implements the 1.0.0 handshake.
+type jsonCodec struct{}
+
+func (jsonCodec) writeRequest(w io.Writer, req *Request) error {
+	if req.Command != CommandConnect {
+		return fmt.Errorf("command %d is not supported by %s", req.Command, ProxyProtocolID)
+	}
+
+	return json.NewEncoder(w).Encode(req)
+}
+
+func (jsonCodec) readRequest(r io.Reader) (*Request, error) {
+	var req Request
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	req.Command = CommandConnect
+
+	return &req, nil
+}
+
+func (jsonCodec) writeResponse(w io.Writer, resp *ProxyResponse) error {
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func (jsonCodec) readResponse(r io.Reader) (*ProxyResponse, error) {
+	var resp ProxyResponse
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// binaryCodec implements the 2.0.0 handshake.
+type binaryCodec struct{}
+
+func (binaryCodec) writeRequest(w io.Writer, req *Request) error {
+	f := &frame{op: byte(req.Command)}
+	f.set(fieldAddress, []byte(req.ProxyAddress))
+	f.set(fieldPeer, []byte(req.Peer))
+	f.set(fieldTunnel, []byte(req.Tunnel))
+
+	for _, addr := range req.PeerAddrs {
+		f.set(fieldPeerAddr, []byte(addr))
+	}
+
+	return writeFrame(w, f)
+}
+
+func (binaryCodec) readRequest(r io.Reader) (*Request, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		Command:      Command(f.op),
+		ProxyAddress: f.getString(fieldAddress),
+		Peer:         f.getString(fieldPeer),
+		Tunnel:       f.getString(fieldTunnel),
+	}
+
+	for _, addr := range f.getAll(fieldPeerAddr) {
+		req.PeerAddrs = append(req.PeerAddrs, string(addr))
+	}
+
+	return req, nil
+}
+
+func (binaryCodec) writeResponse(w io.Writer, resp *ProxyResponse) error {
+	f := &frame{op: statusOK}
+	if resp.Status != StatusOK {
+		f.op = byte(CodeGeneralFailure)
+		if resp.Code != 0 {
+			f.op = byte(resp.Code)
+		}
+	}
+
+	f.set(fieldMessage, []byte(resp.Message))
+	f.set(fieldAddress, []byte(resp.Address))
+
+	return writeFrame(w, f)
+}
+
+func (binaryCodec) readResponse(r io.Reader) (*ProxyResponse, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ProxyResponse{
+		Status:  StatusOK,
+		Message: f.getString(fieldMessage),
+		Address: f.getString(fieldAddress),
+	}
+
+	if f.op != statusOK {
+		resp.Status = StatusError
+		resp.Code = ErrorCode(f.op)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBinaryCodec_RequestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := binaryCodec{}
+	if err := c.writeRequest(&buf, &Request{Command: CommandConnect, ProxyAddress: "example.com:443"}); err != nil {
+		t.Fatalf("writeRequest failed: %v", err)
+	}
+
+	req, err := c.readRequest(&buf)
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+
+	if req.Command != CommandConnect || req.ProxyAddress != "example.com:443" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+}
+
+func TestBinaryCodec_ForwardRequestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	sent := &Request{
+		Command:   CommandForward,
+		Peer:      "12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp",
+		PeerAddrs: []string{"/ip4/10.0.0.1/tcp/4000", "/ip6/::1/tcp/4000"},
+	}
+
+	c := binaryCodec{}
+	if err := c.writeRequest(&buf, sent); err != nil {
+		t.Fatalf("writeRequest failed: %v", err)
+	}
+
+	req, err := c.readRequest(&buf)
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+
+	if req.Command != CommandForward || req.Peer != sent.Peer || len(req.PeerAddrs) != 2 || req.PeerAddrs[1] != sent.PeerAddrs[1] {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+}
+
+func TestBinaryCodec_ListenRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := binaryCodec{}
+	if err := c.writeRequest(&buf, &Request{Command: CommandListen, ProxyAddress: ":8080", Tunnel: "token"}); err != nil {
+		t.Fatalf("writeRequest failed: %v", err)
+	}
+
+	req, err := c.readRequest(&buf)
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+
+	if req.Command != CommandListen || req.ProxyAddress != ":8080" || req.Tunnel != "token" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+
+	if err := c.writeResponse(&buf, &ProxyResponse{Status: StatusOK, Address: "0.0.0.0:8080"}); err != nil {
+		t.Fatalf("writeResponse failed: %v", err)
+	}
+
+	resp, err := c.readResponse(&buf)
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+
+	if resp.Status != StatusOK || resp.Address != "0.0.0.0:8080" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestBinaryCodec_ResponseRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := binaryCodec{}
+	if err := c.writeResponse(&buf, &ProxyResponse{Status: StatusError, Message: "boom"}); err != nil {
+		t.Fatalf("writeResponse failed: %v", err)
+	}
+
+	resp, err := c.readResponse(&buf)
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+
+	if resp.Status != StatusError || resp.Message != "boom" {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+}
+
+func TestReadFrame_SkipsUnknownFields(t *testing.T) {
+	var buf bytes.Buffer
+
+	f := &frame{op: byte(CommandConnect)}
+	f.set(0xee, []byte("from the future"))
+	f.set(fieldAddress, []byte("10.0.0.1:80"))
+
+	if err := writeFrame(&buf, f); err != nil {
+		t.Fatalf("writeFrame failed: %v", err)
+	}
+
+	buf.WriteString("trailing stream data")
+
+	req, err := binaryCodec{}.readRequest(&buf)
+	if err != nil {
+		t.Fatalf("readRequest failed: %v", err)
+	}
+
+	if req.ProxyAddress != "10.0.0.1:80" {
+		t.Fatalf("expected address to survive unknown field, got %q", req.ProxyAddress)
+	}
+
+	if buf.String() != "trailing stream data" {
+		t.Fatalf("frame reader consumed stream data: %q", buf.String())
+	}
+}
+
+func TestReadFrame_Malformed(t *testing.T) {
+	data := []byte{0x00, 0x05, handshakeVersion, byte(CommandConnect), fieldAddress, 0x00, 0x09}
+
+	if _, err := readFrame(bytes.NewReader(data)); err != ErrMalformedFrame {
+		t.Fatalf("expected ErrMalformedFrame, got %v", err)
+	}
+}
+
+func TestJSONCodec_ResponseCode(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := jsonCodec{}
+	if err := c.writeResponse(&buf, &ProxyResponse{Status: StatusError, Code: CodeConnectionRefused, Message: "refused"}); err != nil {
+		t.Fatalf("writeResponse failed: %v", err)
+	}
+
+	if !bytes.Contains(buf.Bytes(), []byte(`"code":"connection_refused"`)) {
+		t.Fatalf("expected code by name in %s", buf.String())
+	}
+
+	resp, err := c.readResponse(&buf)
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+
+	var perr *Error
+	if !errors.As(resp.Err(), &perr) || perr.Code != CodeConnectionRefused {
+		t.Fatalf("expected connection refused error, got %v", resp.Err())
+	}
+}
+
+func TestProxyResponse_ErrWithoutCode(t *testing.T) {
+	resp := &ProxyResponse{Status: StatusError, Message: "old node"}
+
+	var perr *Error
+	if !errors.As(resp.Err(), &perr) || perr.Code != CodeGeneralFailure {
+		t.Fatalf("expected general failure, got %v", resp.Err())
+	}
+}
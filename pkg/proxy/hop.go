@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// circuitTimeout bounds how long building a whole circuit may take
+const circuitTimeout = 30 * time.Second
+
+// A circuit is built one node at a time. The client sends CommandForward to
+// the first node on a regular proxy stream, and that node opens a hop stream
+// to the next one and splices the two. The client then runs a Noise handshake
+// with the next node through the splice, using a fresh ephemeral key, and
+// sends its next request inside the secure channel. Every node only learns its
+// neighbours: the first one sees the client but not the destination, and the
+// last one sees the destination but not the client.
+
+// handleHop serves a stream a node forwarded on behalf of a client. Limits and
+// usage are accounted to the forwarding node, since the client is anonymous
+// here.
+func (h *Server) handleHop(s network.Stream) {
+	defer s.Close()
+
+	remotePeer := s.Conn().RemotePeer()
+
+	logging.Logger.Info("New hop stream", "from", remotePeer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), circuitTimeout)
+	defer cancel()
+
+	raw := &pkgnetwork.Adapter{Stream: s}
+
+	secure, err := h.noise.SecureInbound(ctx, raw, "")
+	if err != nil {
+		logging.Logger.Error("Failed to secure hop stream", "from", remotePeer, "error", err)
+		_ = s.Reset()
+
+		return
+	}
+
+	defer secure.Close()
+
+	h.serve(&secureConn{Conn: secure, raw: raw}, remotePeer, binaryCodec{}, false)
+}
+
+// secureConn is a Noise channel that can be half-closed by half-closing the
+// connection it runs over. Noise frames are written whole, so the other end
+// reads every frame before it sees EOF.
+type secureConn struct {
+	net.Conn
+	raw net.Conn
+}
+
+func (c *secureConn) CloseWrite() error {
+	return closeWrite(c.raw)
+}
+
+// dialHop opens a hop stream to the next node of a circuit
+func (h *Server) dialHop(ctx context.Context, next string, addrs []string) (net.Conn, error) {
+	id, err := peer.Decode(next)
+	if err != nil {
+		return nil, NewError(CodeGeneralFailure, fmt.Sprintf("invalid next hop %q", next))
+	}
+
+	if id == h.host.ID() {
+		return nil, NewError(CodeGeneralFailure, "next hop is this node")
+	}
+
+	var mas []multiaddr.Multiaddr
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			continue
+		}
+
+		if info, err := peer.AddrInfoFromP2pAddr(ma); err == nil {
+			if info.ID != id {
+				continue
+			}
+
+			for _, a := range info.Addrs {
+				if h.allowedHopAddr(a) {
+					mas = append(mas, a)
+				}
+			}
+
+			continue
+		}
+
+		if h.allowedHopAddr(ma) {
+			mas = append(mas, ma)
+		}
+	}
+
+	h.host.Peerstore().AddAddrs(id, mas, peerstore.TempAddrTTL)
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	s, err := h.host.NewStream(network.WithAllowLimitedConn(ctx, "circuit hop"), id, HopProtocolID)
+	if err != nil {
+		return nil, NewError(CodeHopUnreachable, err.Error())
+	}
+
+	return &pkgnetwork.Adapter{Stream: s}, nil
+}
+
+// allowedHopAddr reports whether the node may dial a next-hop address sent by
+// a client. The address must start with an IP that the egress policy lets the
+// node reach on its TCP or UDP port, the same check CONNECT goes through, so
+// circuits cannot be used to probe the node's internal network. DNS names are
+// refused since they would be resolved outside the policy.
+func (h *Server) allowedHopAddr(ma multiaddr.Multiaddr) bool {
+	var ip netip.Addr
+	var port uint16
+
+	multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+		switch c.Code() {
+		case multiaddr.P_IP4, multiaddr.P_IP6:
+			if ip.IsValid() {
+				return false
+			}
+
+			ip, _ = netip.AddrFromSlice(c.RawValue())
+		case multiaddr.P_TCP, multiaddr.P_UDP:
+			if len(c.RawValue()) == 2 {
+				port = binary.BigEndian.Uint16(c.RawValue())
+			}
+
+			return false
+		default:
+			return ip.IsValid()
+		}
+
+		return true
+	})
+
+	if !ip.IsValid() || port == 0 {
+		return false
+	}
+
+	return h.policy.Allowed(policy.Destination{IP: ip.Unmap(), Port: port})
+}
+
+// DialPath connects to addr through a circuit of nodes, the last of which is
+// the exit. A path of one node is the same as Dial.
+func (d *Client) DialPath(ctx context.Context, path []*Connection, addr string) (net.Conn, error) {
+	if len(path) == 0 {
+		return nil, errors.New("empty circuit path")
+	}
+
+	if len(path) == 1 {
+		return d.Dial(ctx, path[0].PeerID, addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, circuitTimeout)
+	defer cancel()
+
+	entry := path[0]
+
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "ProxyProtocolID"), entry.PeerID, ProxyProtocolV2ID)
+	if err != nil {
+		return nil, &NodeError{PeerID: entry.PeerID, Err: fmt.Errorf("failed to open stream: %w", err)}
+	}
+
+	ids := make([]peer.ID, len(path))
+	for i, c := range path {
+		ids[i] = c.PeerID
+	}
+
+	base := pkgnetwork.NewAdapter(stream, d.load(ids...))
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = base.SetDeadline(deadline)
+	}
+
+	var conn net.Conn = base
+
+	if err := request(conn, path, 0, forwardRequest(path[1])); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	for i := 1; i < len(path); i++ {
+		secure, err := secureHop(ctx, conn, path[i].PeerID)
+		if err != nil {
+			_ = conn.Close()
+			return nil, &NodeError{PeerID: path[i].PeerID, Err: fmt.Errorf("failed to secure hop: %w", err)}
+		}
+
+		conn = secure
+
+		req := &Request{Command: CommandConnect, ProxyAddress: addr}
+		if i < len(path)-1 {
+			req = forwardRequest(path[i+1])
+		}
+
+		if err := request(conn, path, i, req); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	_ = base.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func forwardRequest(next *Connection) *Request {
+	req := &Request{Command: CommandForward, Peer: next.PeerID.String()}
+	if next.Addr != "" {
+		req.PeerAddrs = []string{next.Addr}
+	}
+
+	return req
+}
+
+// secureHop runs a Noise handshake with the node id through conn, using a
+// fresh key so nodes cannot link hops of the same client
+func secureHop(ctx context.Context, conn net.Conn, id peer.ID) (net.Conn, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tpt, err := noise.New(noise.ID, priv, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := tpt.SecureOutbound(ctx, conn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{Conn: secure, raw: conn}, nil
+}
+
+// request sends req to the node at path[i] and waits for its response.
+// Node-side failures are reported as a NodeError of the node they concern, so
+// a circuit can be rebuilt without it.
+func request(conn net.Conn, path []*Connection, i int, req *Request) error {
+	hop := path[i].PeerID
+	c := binaryCodec{}
+
+	if err := c.writeRequest(conn, req); err != nil {
+		return &NodeError{PeerID: hop, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	resp, err := c.readResponse(conn)
+	if err != nil {
+		return &NodeError{PeerID: hop, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	err = resp.Err()
+	if err == nil {
+		return nil
+	}
+
+	var perr *Error
+	if errors.As(err, &perr) && perr.Code == CodeHopUnreachable && i+1 < len(path) {
+		return &NodeError{PeerID: path[i+1].PeerID, Err: err}
+	}
+
+	if IsNodeError(err) {
+		return &NodeError{PeerID: hop, Err: err}
+	}
+
+	return err
+}
+
+// circuit reports whether dials go through more than one node
+func (d *Client) circuit() bool {
+	return d.Hops > 1 || len(d.Path) > 0
+}
+
+// dialCircuit dials addr through a circuit built from the pool. When a node of
+// the circuit fails, a new circuit without it is built within the attempt
+// budget. A fixed path is only tried once.
+func (d *Client) dialCircuit(ctx context.Context, route Route, addr string) (net.Conn, error) {
+	attempts := d.attempts()
+	if len(d.Path) > 0 {
+		attempts = 1
+	}
+
+	tried := make(map[peer.ID]bool)
+
+	var lastErr error
+	for range attempts {
+		path, err := d.buildPath(route, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+
+			return nil, err
+		}
+
+		conn, err := d.DialPath(ctx, path, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		var nerr *NodeError
+		if !errors.As(err, &nerr) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		tried[nerr.PeerID] = true
+
+		logging.Logger.Warn("Circuit node failed; rebuilding circuit", "node", nerr.PeerID, "error", err)
+	}
+
+	return nil, lastErr
+}
+
+// buildPath picks the nodes of a circuit: the configured path, or Hops
+// distinct nodes among those not excluded. The exit is picked first, within
+// route; the nodes before it by the route's strategy alone.
+func (d *Client) buildPath(route Route, exclude map[peer.ID]bool) ([]*Connection, error) {
+	if len(d.Path) > 0 {
+		path := make([]*Connection, 0, len(d.Path))
+		for _, id := range d.Path {
+			c := d.Pool.Get(id)
+			if c == nil {
+				return nil, fmt.Errorf("circuit node %s is not connected", id)
+			}
+
+			path = append(path, c)
+		}
+
+		return path, nil
+	}
+
+	strategy := route.strategy(d.Pool)
+
+	outside, err := route.exclude(d.Pool)
+	if err != nil {
+		return nil, err
+	}
+
+	maps.Copy(outside, exclude)
+
+	exit := d.Pool.SelectKey(strategy, route.Key, outside)
+	if exit == nil {
+		return nil, fmt.Errorf("not enough exit nodes for a %d-hop circuit", d.Hops)
+	}
+
+	skip := maps.Clone(exclude)
+	skip[exit.PeerID] = true
+
+	path := make([]*Connection, 0, d.Hops)
+	for range d.Hops - 1 {
+		c := d.Pool.Select(strategy, skip)
+		if c == nil {
+			return nil, fmt.Errorf("not enough exit nodes for a %d-hop circuit", d.Hops)
+		}
+
+		skip[c.PeerID] = true
+		path = append(path, c)
+	}
+
+	return append(path, exit), nil
+}
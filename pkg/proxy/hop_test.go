@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestAllowedHopAddr(t *testing.T) {
+	h := &Server{policy: policy.Default()}
+
+	cases := map[string]bool{
+		"/ip4/93.184.216.34/tcp/4000":             true,
+		"/ip6/2606:2800:220:1::/udp/4000/quic-v1": true,
+		"/ip4/127.0.0.1/tcp/4000":                 false,
+		"/ip4/169.254.169.254/tcp/80":             false,
+		"/ip4/10.0.0.5/tcp/22":                    false,
+		"/ip6/64:ff9b::a00:1/tcp/4000":            false,
+		"/dns4/localhost/tcp/4000":                false,
+		"/ip4/93.184.216.34/tcp/4000/p2p-circuit": true,
+		"/ip4/192.168.1.1/tcp/4001/p2p-circuit":   false,
+	}
+
+	for s, want := range cases {
+		ma, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			t.Fatalf("invalid multiaddr %q: %v", s, err)
+		}
+
+		if got := h.allowedHopAddr(ma); got != want {
+			t.Errorf("allowedHopAddr(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPool_LeastLoaded(t *testing.T) {
+	p := NewPool(LeastConnectionsStrategy)
+	p.Add(peer.ID("a"), "", nil, 0, 0)
+	p.Add(peer.ID("b"), "", nil, 0, 0)
+	p.Add(peer.ID("c"), "", nil, 0, 0)
+
+	a, b, c := p.Get("a"), p.Get("b"), p.Get("c")
+
+	// a carries two idle streams, b one long download
+	load{a}.Opened()
+	load{a}.Opened()
+	load{b}.Opened()
+	load{b}.Transferred(1 << 20)
+
+	for range 20 {
+		if got := p.Select(LeastConnectionsStrategy, nil); got != c {
+			t.Fatalf("expected the idle node, got %s", got.PeerID)
+		}
+	}
+
+	p.Record("c", 0, errors.New("node down"))
+
+	if got := p.Select(LeastConnectionsStrategy, nil); got != b {
+		t.Fatalf("expected the healthy node with the fewest streams, got %s", got.PeerID)
+	}
+
+	if got := p.Select(LeastBytesStrategy, nil); got != a {
+		t.Fatalf("expected the healthy node with the fewest bytes, got %s", got.PeerID)
+	}
+
+	load{b}.Closed(1 << 20)
+
+	if b.Streams() != 0 || b.InFlight() != 0 {
+		t.Fatalf("expected no load after close, got %d streams and %d bytes", b.Streams(), b.InFlight())
+	}
+}
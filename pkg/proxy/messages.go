@@ -3,15 +3,72 @@ package proxy
 import "github.com/libp2p/go-libp2p/core/protocol"
 
 const (
-	ProxyProtocolID = protocol.ID("/bethrou/proxy/1.0.0")
-	PingProtocolID  = protocol.ID("/bethrou/ping/1.0.0")
+	ProxyProtocolID   = protocol.ID("/bethrou/proxy/1.0.0")
+	ProxyProtocolV2ID = protocol.ID("/bethrou/proxy/2.0.0")
+	PingProtocolID    = protocol.ID("/bethrou/ping/1.0.0")
+	UDPProtocolID     = protocol.ID("/bethrou/udp/1.0.0")
+	DNSProtocolID     = protocol.ID("/bethrou/dns/1.0.0")
+	HopProtocolID     = protocol.ID("/bethrou/hop/1.0.0")
+	ReverseProtocolID = protocol.ID("/bethrou/reverse/1.0.0")
+)
+
+// ProxyProtocols lists the proxy protocol versions in order of preference.
+// Clients offer all of them and multistream picks the first one the node
+// supports, so nodes that only speak 1.0.0 keep working.
+var ProxyProtocols = []protocol.ID{ProxyProtocolV2ID, ProxyProtocolID}
+
+// Command identifies what a proxy request asks the node to do.
+type Command uint8
+
+const (
+	// CommandConnect opens a TCP connection to the requested address.
+	CommandConnect Command = 1
+	// CommandForward opens a hop stream to the next node of a circuit.
+	CommandForward Command = 2
+	// CommandListen opens a listener on the node for a reverse tunnel.
+	CommandListen Command = 3
+	// CommandBind accepts one inbound connection on the node, as SOCKS BIND.
+	CommandBind Command = 4
 )
 
 type Request struct {
-	ProxyAddress string `json:"address"`
+	Command      Command `json:"-"`
+	ProxyAddress string  `json:"address"`
+	// Peer and PeerAddrs name the next node of a CommandForward request. The
+	// addresses let the node reach a peer it is not connected to yet.
+	Peer      string   `json:"-"`
+	PeerAddrs []string `json:"-"`
+	// Tunnel is the token of a reverse tunnel. It is chosen by the client in
+	// CommandListen and sent back with every connection the node accepts.
+	Tunnel string `json:"-"`
 }
 
 type ProxyResponse struct {
-	Status  string `json:"status"`
-	Message string `json:"message,omitempty"`
+	Status  string    `json:"status"`
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message,omitempty"`
+	// Address is the address the node listens on for CommandListen and
+	// CommandBind, and the address of the accepted peer in the second
+	// CommandBind response
+	Address string `json:"-"`
+}
+
+// Err returns the failure described by a non-ok response, or nil. Responses
+// from nodes that predate error codes are reported as CodeGeneralFailure.
+func (r *ProxyResponse) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+
+	code := r.Code
+	if code == 0 {
+		code = CodeGeneralFailure
+	}
+
+	return NewError(code, r.Message)
 }
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
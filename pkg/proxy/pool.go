@@ -1,7 +1,11 @@
 package proxy
 
 import (
+	"hash/fnv"
+	"maps"
+	"math"
 	"math/rand"
+	"slices"
 	"sync"
 	"time"
 
@@ -12,8 +16,22 @@ type PoolStrategy string
 
 const (
 	RandomStrategy     PoolStrategy = "random"
-	FastestStrategy    PoolStrategy = "latency"
+	FastestStrategy    PoolStrategy = "fastest"
 	RoundRobinStrategy PoolStrategy = "round-robin"
+	// StickyStrategy picks nodes by rendezvous hashing of a per-request key,
+	// so the same key keeps using the same node and only the keys of a node
+	// that leaves move elsewhere. Requests without a key are spread randomly.
+	StickyStrategy PoolStrategy = "sticky"
+	// WeightedStrategy picks nodes at random in proportion to their weight,
+	// among the healthy nodes of the most preferred priority tier that has
+	// any
+	WeightedStrategy PoolStrategy = "weighted"
+	// LeastConnectionsStrategy picks the healthy node with the fewest open
+	// streams
+	LeastConnectionsStrategy PoolStrategy = "least-connections"
+	// LeastBytesStrategy picks the healthy node whose open streams carried the
+	// fewest bytes, so long downloads weigh more than idle connections
+	LeastBytesStrategy PoolStrategy = "least-bytes"
 )
 
 type Pool struct {
@@ -21,12 +39,20 @@ type Pool struct {
 	mu       sync.RWMutex
 	strategy PoolStrategy
 	rrIndex  int
+	breaker  BreakerConfig
 }
 
+// NewPool creates an empty pool using strategy, or random selection when it
+// is empty
 func NewPool(strategy PoolStrategy) *Pool {
+	if strategy == "" {
+		strategy = RandomStrategy
+	}
+
 	return &Pool{
 		conns:    make([]*Connection, 0),
-		strategy: RandomStrategy,
+		strategy: strategy,
+		breaker:  DefaultBreaker,
 	}
 }
 
@@ -45,26 +71,119 @@ func (p *Pool) GetStrategy() PoolStrategy {
 }
 
 func (p *Pool) SelectByStrategy(strategy PoolStrategy) *Connection {
+	return p.Select(strategy, nil)
+}
+
+// Select picks a connection with the given strategy, skipping the peers in
+// exclude. It returns nil when no connection is left.
+func (p *Pool) Select(strategy PoolStrategy, exclude map[peer.ID]bool) *Connection {
+	return p.SelectKey(strategy, "", exclude)
+}
+
+// SelectKey is Select for a request identified by key, which the sticky
+// strategy hashes. Other strategies ignore it. A half-open node is only
+// returned to the request that takes its trial.
+func (p *Pool) SelectKey(strategy PoolStrategy, key string, exclude map[peer.ID]bool) *Connection {
+	for {
+		conn := p.selectKey(strategy, key, exclude)
+		if conn == nil {
+			return nil
+		}
+
+		p.mu.Lock()
+		ok := p.claim(conn)
+		p.mu.Unlock()
+
+		if ok {
+			return conn
+		}
+
+		// Another request took the trial between the pick and the claim
+		skip := maps.Clone(exclude)
+		if skip == nil {
+			skip = make(map[peer.ID]bool)
+		}
+
+		skip[conn.PeerID] = true
+		exclude = skip
+	}
+}
+
+func (p *Pool) selectKey(strategy PoolStrategy, key string, exclude map[peer.ID]bool) *Connection {
 	switch strategy {
-	case RandomStrategy:
-		return p.SelectRandom()
 	case FastestStrategy:
-		return p.SelectFastest()
+		return p.selectFastest(exclude)
 	case RoundRobinStrategy:
-		return p.SelectRoundRobin()
+		return p.selectRoundRobin(exclude)
+	case WeightedStrategy:
+		return p.selectWeighted(exclude)
+	case LeastConnectionsStrategy:
+		return p.selectLeast(exclude, (*Connection).Streams)
+	case LeastBytesStrategy:
+		return p.selectLeast(exclude, (*Connection).InFlight)
+	case StickyStrategy:
+		if key == "" {
+			return p.selectRandom(exclude)
+		}
+
+		return p.selectSticky(key, exclude)
 	default:
-		return p.SelectRandom()
+		return p.selectRandom(exclude)
 	}
 }
 
-func (p *Pool) Add(peerID peer.ID, addr string) {
+// candidates returns the connections not in exclude whose breaker is not
+// open and that are not running a half-open trial. When every one left is
+// ejected they are all returned, since trying an ejected node beats failing
+// outright. The caller must hold p.mu.
+func (p *Pool) candidates(exclude map[peer.ID]bool) []*Connection {
+	now := time.Now()
+
+	conns := make([]*Connection, 0, len(p.conns))
+	ejected := make([]*Connection, 0)
+
+	for _, conn := range p.conns {
+		switch {
+		case exclude[conn.PeerID]:
+		case conn.breaker.testing(now, p.breaker.Ejection):
+		case conn.breaker.ejected(now):
+			ejected = append(ejected, conn)
+		default:
+			conns = append(conns, conn)
+		}
+	}
+
+	if len(conns) == 0 {
+		return ejected
+	}
+
+	return conns
+}
+
+// Add puts the connection to peerID in the pool with its labels, weight and
+// priority tier, all set at once so no selection sees it half set up. A peer
+// already in the pool is updated in place and keeps its stats.
+func (p *Pool) Add(peerID peer.ID, addr string, labels map[string]string, weight int, priority int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	for _, conn := range p.conns {
+		if conn.PeerID == peerID {
+			conn.Addr = addr
+			conn.Labels = labels
+			conn.Weight = weight
+			conn.Priority = priority
+
+			return
+		}
+	}
+
 	p.conns = append(p.conns, &Connection{
-		PeerID:  peerID,
-		Addr:    addr,
-		Latency: 0,
+		PeerID:   peerID,
+		Addr:     addr,
+		Labels:   labels,
+		Weight:   weight,
+		Priority: priority,
 	})
 }
 
@@ -80,6 +199,35 @@ func (p *Pool) Remove(peerID peer.ID) {
 	}
 }
 
+// Get returns the connection to peerID, or nil when it is not in the pool
+func (p *Pool) Get(peerID peer.ID) *Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, conn := range p.conns {
+		if conn.PeerID == peerID {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// Match returns the connections whose labels match sel
+func (p *Pool) Match(sel Selector) []*Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	conns := make([]*Connection, 0, len(p.conns))
+	for _, conn := range p.conns {
+		if sel.Matches(conn.Labels) {
+			conns = append(conns, conn)
+		}
+	}
+
+	return conns
+}
+
 func (p *Pool) All() []*Connection {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -104,63 +252,192 @@ func (p *Pool) Clear() {
 	p.conns = make([]*Connection, 0)
 }
 
-func (p *Pool) UpdateLatency(peerID peer.ID, latency time.Duration) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	for _, conn := range p.conns {
-		if conn.PeerID == peerID {
-			conn.Latency = latency
-			return
-		}
-	}
+func (p *Pool) SelectRandom() *Connection {
+	return p.selectRandom(nil)
 }
 
-func (p *Pool) SelectRandom() *Connection {
+func (p *Pool) selectRandom(exclude map[peer.ID]bool) *Connection {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if len(p.conns) == 0 {
+	conns := p.candidates(exclude)
+	if len(conns) == 0 {
 		return nil
 	}
 
-	idx := rand.Intn(len(p.conns))
-	return p.conns[idx]
+	idx := rand.Intn(len(conns))
+	return conns[idx]
 }
 
 func (p *Pool) SelectFastest() *Connection {
+	return p.selectFastest(nil)
+}
+
+// selectFastest picks the candidate with the lowest Stats.Score, or a random
+// one when no candidate has a usable score yet
+func (p *Pool) selectFastest(exclude map[peer.ID]bool) *Connection {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if len(p.conns) == 0 {
+	conns := p.candidates(exclude)
+	if len(conns) == 0 {
 		return nil
 	}
 
 	var best *Connection
-	for _, conn := range p.conns {
-		if best == nil || (conn.Latency > 0 && conn.Latency < best.Latency) {
-			best = conn
+	bestScore := math.Inf(1)
+
+	for _, conn := range conns {
+		if score := conn.stats.summary().Score(); score < bestScore {
+			best, bestScore = conn, score
 		}
 	}
 
-	if best == nil || best.Latency == 0 {
-		idx := rand.Intn(len(p.conns))
-		return p.conns[idx]
+	if best == nil {
+		idx := rand.Intn(len(conns))
+		return conns[idx]
 	}
 
 	return best
 }
 
 func (p *Pool) SelectRoundRobin() *Connection {
+	return p.selectRoundRobin(nil)
+}
+
+func (p *Pool) selectRoundRobin(exclude map[peer.ID]bool) *Connection {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if len(p.conns) == 0 {
+	conns := p.candidates(exclude)
+
+	for range p.conns {
+		conn := p.conns[p.rrIndex%len(p.conns)]
+		p.rrIndex = (p.rrIndex + 1) % len(p.conns)
+
+		if slices.Contains(conns, conn) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// selectSticky returns the candidate with the highest rendezvous weight for
+// key. Each node's weight depends only on the key and the node, so removing a
+// node only moves the keys it had.
+func (p *Pool) selectSticky(key string, exclude map[peer.ID]bool) *Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var best *Connection
+	var bestWeight uint64
+
+	for _, conn := range p.candidates(exclude) {
+		if w := rendezvousWeight(key, conn.PeerID); best == nil || w > bestWeight {
+			best, bestWeight = conn, w
+		}
+	}
+
+	return best
+}
+
+// rendezvousWeight hashes key and id with FNV-1a, then mixes the result with
+// the SplitMix64 finalizer so keys that differ in a few bytes spread evenly
+func rendezvousWeight(key string, id peer.ID) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(id))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+// selectWeighted picks a candidate by weight within the lowest priority tier
+// that has a healthy candidate. When none is healthy, the lowest tier is used
+// anyway so requests are still attempted.
+func (p *Pool) selectWeighted(exclude map[peer.ID]bool) *Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var tier []*Connection
+	tierHealthy := false
+
+	for _, conn := range p.candidates(exclude) {
+		healthy := conn.Healthy()
+
+		switch {
+		case tier == nil,
+			healthy && !tierHealthy,
+			healthy == tierHealthy && conn.Priority < tier[0].Priority:
+			tier = []*Connection{conn}
+			tierHealthy = healthy
+		case healthy == tierHealthy && conn.Priority == tier[0].Priority:
+			tier = append(tier, conn)
+		}
+	}
+
+	if len(tier) == 0 {
 		return nil
 	}
 
-	conn := p.conns[p.rrIndex%len(p.conns)]
-	p.rrIndex = (p.rrIndex + 1) % len(p.conns)
+	total := 0
+	for _, conn := range tier {
+		total += weight(conn)
+	}
+
+	n := rand.Intn(total)
+	for _, conn := range tier {
+		if n -= weight(conn); n < 0 {
+			return conn
+		}
+	}
+
+	return tier[len(tier)-1]
+}
+
+// weight returns the selection weight of conn. Unset weights count as one.
+func weight(conn *Connection) int {
+	if conn.Weight <= 0 {
+		return 1
+	}
+
+	return conn.Weight
+}
+
+// selectLeast picks the candidate with the lowest load, preferring healthy
+// ones. Ties are broken at random so idle nodes share new streams.
+func (p *Pool) selectLeast(exclude map[peer.ID]bool, metric func(*Connection) int64) *Connection {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var best []*Connection
+	var bestLoad int64
+	bestHealthy := false
+
+	for _, conn := range p.candidates(exclude) {
+		l, healthy := metric(conn), conn.Healthy()
+
+		switch {
+		case best == nil,
+			healthy && !bestHealthy,
+			healthy == bestHealthy && l < bestLoad:
+			best, bestLoad, bestHealthy = []*Connection{conn}, l, healthy
+		case healthy == bestHealthy && l == bestLoad:
+			best = append(best, conn)
+		}
+	}
+
+	if len(best) == 0 {
+		return nil
+	}
 
-	return conn
+	return best[rand.Intn(len(best))]
 }
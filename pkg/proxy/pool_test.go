@@ -0,0 +1,323 @@
+package proxy_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/henrybarreto/bethrou/pkg/proxy"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var errDown = errors.New("node down")
+
+func TestPool_SelectExcluding(t *testing.T) {
+	p := proxy.NewPool(proxy.RoundRobinStrategy)
+	p.Add(peer.ID("a"), "", nil, 0, 0)
+	p.Add(peer.ID("b"), "", nil, 0, 0)
+	p.Add(peer.ID("c"), "", nil, 0, 0)
+
+	strategies := []proxy.PoolStrategy{proxy.RandomStrategy, proxy.FastestStrategy, proxy.RoundRobinStrategy, proxy.WeightedStrategy, proxy.LeastConnectionsStrategy, proxy.LeastBytesStrategy}
+	for _, s := range strategies {
+		exclude := map[peer.ID]bool{"a": true, "c": true}
+
+		for range 5 {
+			conn := p.Select(s, exclude)
+			if conn == nil || conn.PeerID != "b" {
+				t.Fatalf("%s: expected the only remaining peer, got %+v", s, conn)
+			}
+		}
+
+		exclude["b"] = true
+		if conn := p.Select(s, exclude); conn != nil {
+			t.Fatalf("%s: expected no connection when all are excluded, got %+v", s, conn)
+		}
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	sel, err := proxy.ParseSelector("region=eu, datacenter")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"region": "eu", "datacenter": ""}, true},
+		{map[string]string{"region": "eu", "datacenter": "fra1", "tier": "cheap"}, true},
+		{map[string]string{"region": "us", "datacenter": "nyc1"}, false},
+		{map[string]string{"region": "eu"}, false},
+		{nil, false},
+	}
+
+	for _, c := range cases {
+		if got := sel.Matches(c.labels); got != c.want {
+			t.Fatalf("%s on %v: expected %v, got %v", sel, c.labels, c.want, got)
+		}
+	}
+
+	if _, err := proxy.ParseSelector("region=eu,,"); err == nil {
+		t.Fatal("expected an error for an empty term")
+	}
+}
+
+func TestPool_StickyMovesOnlyRemovedNodeKeys(t *testing.T) {
+	p := proxy.NewPool(proxy.StickyStrategy)
+	for _, id := range []peer.ID{"a", "b", "c", "d"} {
+		p.Add(id, "", nil, 0, 0)
+	}
+
+	keys := make([]string, 200)
+	before := make(map[string]peer.ID, len(keys))
+
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host-%d.example.com", i)
+		before[keys[i]] = p.SelectKey(proxy.StickyStrategy, keys[i], nil).PeerID
+
+		if again := p.SelectKey(proxy.StickyStrategy, keys[i], nil).PeerID; again != before[keys[i]] {
+			t.Fatalf("%s: expected the same node twice, got %s and %s", keys[i], before[keys[i]], again)
+		}
+	}
+
+	p.Remove("b")
+
+	for _, key := range keys {
+		after := p.SelectKey(proxy.StickyStrategy, key, nil).PeerID
+		if before[key] != "b" && after != before[key] {
+			t.Fatalf("%s: moved from %s to %s although only b left", key, before[key], after)
+		}
+
+		if after == "b" {
+			t.Fatalf("%s: still on the removed node", key)
+		}
+	}
+}
+
+func TestPool_Match(t *testing.T) {
+	p := proxy.NewPool(proxy.RandomStrategy)
+	p.Add(peer.ID("a"), "", map[string]string{"region": "eu", "tier": "primary"}, 0, 0)
+	p.Add(peer.ID("b"), "", map[string]string{"region": "us"}, 0, 0)
+	p.Add(peer.ID("c"), "", map[string]string{"region": "eu"}, 0, 0)
+
+	sel, _ := proxy.ParseSelector("region=eu")
+
+	var got []peer.ID
+	for _, conn := range p.Match(sel) {
+		got = append(got, conn.PeerID)
+	}
+
+	if len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Fatalf("expected a and c, got %v", got)
+	}
+
+	if conns := p.Match(proxy.Selector{}); len(conns) != 3 {
+		t.Fatalf("expected an empty selector to match every node, got %d", len(conns))
+	}
+
+	// A rejoin updates the node in place instead of adding it twice
+	p.Add(peer.ID("b"), "", map[string]string{"region": "eu"}, 0, 0)
+
+	if conns := p.Match(proxy.Selector{}); len(conns) != 3 {
+		t.Fatalf("expected a re-added node to not be duplicated, got %d nodes", len(conns))
+	}
+
+	if conns := p.Match(sel); len(conns) != 3 {
+		t.Fatalf("expected the re-added node to carry its new labels, got %d matches", len(conns))
+	}
+}
+
+func TestPool_WeightedPrefersHealthyTier(t *testing.T) {
+	p := proxy.NewPool(proxy.WeightedStrategy)
+	p.Add(peer.ID("a"), "", nil, 3, 0)
+	p.Add(peer.ID("b"), "", nil, 1, 0)
+	p.Add(peer.ID("backup"), "", nil, 0, 1)
+
+	counts := make(map[peer.ID]int)
+	for range 4000 {
+		counts[p.Select(proxy.WeightedStrategy, nil).PeerID]++
+	}
+
+	if counts["backup"] != 0 {
+		t.Fatalf("expected the backup tier to be unused, got %v", counts)
+	}
+
+	if counts["a"] < 2*counts["b"] {
+		t.Fatalf("expected a to get about three times the picks of b, got %v", counts)
+	}
+
+	p.Record("a", 0, errDown)
+	p.Record("b", 0, errDown)
+
+	if conn := p.Select(proxy.WeightedStrategy, nil); conn.PeerID != "backup" {
+		t.Fatalf("expected the backup when the primary tier is down, got %s", conn.PeerID)
+	}
+
+	p.Record("backup", 0, errDown)
+
+	if conn := p.Select(proxy.WeightedStrategy, nil); conn.PeerID == "backup" {
+		t.Fatal("expected the primary tier when every node is down")
+	}
+}
+
+func TestPool_FastestRanksOnStats(t *testing.T) {
+	p := proxy.NewPool(proxy.FastestStrategy)
+	for _, id := range []peer.ID{"steady", "jittery", "lossy", "down"} {
+		p.Add(id, "", nil, 0, 0)
+	}
+
+	for i := range 10 {
+		p.Record("steady", 40*time.Millisecond, nil)
+
+		if i%2 == 0 {
+			p.Record("jittery", 5*time.Millisecond, nil)
+		} else {
+			p.Record("jittery", 80*time.Millisecond, nil)
+		}
+
+		if i%2 == 0 {
+			p.Record("lossy", 0, errDown)
+		}
+
+		p.Record("lossy", 30*time.Millisecond, nil)
+		p.Record("down", time.Millisecond, nil)
+	}
+
+	p.Record("down", 0, errDown)
+
+	st := p.Stats("steady")
+	if st.EWMA != 40*time.Millisecond || st.Jitter != 0 || st.P95 != 40*time.Millisecond || st.Success != 1 || st.Probes != 10 {
+		t.Fatalf("unexpected stats for a steady node: %+v", st)
+	}
+
+	if st := p.Stats("lossy"); st.Success > 0.7 || st.Success < 0.6 {
+		t.Fatalf("expected about two thirds of the lossy node's probes to succeed, got %+v", st)
+	}
+
+	if conn := p.Select(proxy.FastestStrategy, nil); conn.PeerID != "steady" {
+		t.Fatalf("expected the steady node, got %s", conn.PeerID)
+	}
+}
+
+func TestPool_BreakerEjectsFailingNodes(t *testing.T) {
+	logging.Setup(nil)
+
+	p := proxy.NewPool(proxy.RoundRobinStrategy)
+	for _, id := range []peer.ID{"a", "b", "c", "d"} {
+		p.Add(id, "", nil, 0, 0)
+	}
+
+	p.SetBreaker(proxy.BreakerConfig{Failures: 2, Ejection: 50 * time.Millisecond, MaxEjected: 0.5})
+
+	nodeErr := &proxy.NodeError{PeerID: "a", Err: errDown}
+
+	p.Report("a", proxy.NewError(proxy.CodeConnectionRefused, "refused"))
+	p.Report("a", proxy.NewError(proxy.CodeConnectionRefused, "refused"))
+	if state := p.State("a"); state != proxy.BreakerClosed {
+		t.Fatalf("expected destination errors to leave the breaker closed, got %s", state)
+	}
+
+	for _, id := range []peer.ID{"a", "b", "c"} {
+		p.Report(id, nodeErr)
+		p.Report(id, nodeErr)
+	}
+
+	if p.State("a") != proxy.BreakerOpen || p.State("b") != proxy.BreakerOpen {
+		t.Fatalf("expected a and b ejected, got %s and %s", p.State("a"), p.State("b"))
+	}
+
+	if state := p.State("c"); state != proxy.BreakerClosed {
+		t.Fatalf("expected c kept past the ejection limit, got %s", state)
+	}
+
+	for _, s := range []proxy.PoolStrategy{proxy.RandomStrategy, proxy.RoundRobinStrategy, proxy.FastestStrategy} {
+		for range 10 {
+			if conn := p.Select(s, nil); conn.PeerID == "a" || conn.PeerID == "b" {
+				t.Fatalf("%s: selected ejected node %s", s, conn.PeerID)
+			}
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if state := p.State("a"); state != proxy.BreakerHalfOpen {
+		t.Fatalf("expected a half-open after the ejection, got %s", state)
+	}
+
+	// Each half-open node gets a single trial request until it reports back
+	trials := make(map[peer.ID]int)
+	for range 20 {
+		trials[p.Select(proxy.RoundRobinStrategy, nil).PeerID]++
+	}
+
+	if trials["a"] != 1 || trials["b"] != 1 {
+		t.Fatalf("expected one trial each for a and b, got %v", trials)
+	}
+
+	p.Report("a", nil)
+	p.Report("b", nodeErr)
+
+	if p.State("a") != proxy.BreakerClosed || p.State("b") != proxy.BreakerOpen {
+		t.Fatalf("expected a restored and b ejected again, got %s and %s", p.State("a"), p.State("b"))
+	}
+}
+
+func TestPool_BreakerEjectsFromSmallPools(t *testing.T) {
+	logging.Setup(nil)
+
+	for _, n := range []int{1, 2} {
+		p := proxy.NewPool(proxy.RandomStrategy)
+		for i := range n {
+			p.Add(peer.ID(fmt.Sprint(i)), "", nil, 0, 0)
+		}
+
+		nodeErr := &proxy.NodeError{PeerID: "0", Err: errDown}
+		for range proxy.DefaultBreaker.Failures {
+			p.Report("0", nodeErr)
+		}
+
+		if state := p.State("0"); state != proxy.BreakerOpen {
+			t.Fatalf("pool of %d: expected the failing node ejected, got %s", n, state)
+		}
+
+		if n == 2 {
+			for range proxy.DefaultBreaker.Failures {
+				p.Report("1", &proxy.NodeError{PeerID: "1", Err: errDown})
+			}
+
+			if state := p.State("1"); state != proxy.BreakerClosed {
+				t.Fatalf("expected the second node kept past the ejection limit, got %s", state)
+			}
+		}
+	}
+}
+
+func TestPool_BreakerCountsTrialsAsEjected(t *testing.T) {
+	logging.Setup(nil)
+
+	p := proxy.NewPool(proxy.RoundRobinStrategy)
+	for _, id := range []peer.ID{"a", "b"} {
+		p.Add(id, "", nil, 0, 0)
+	}
+
+	p.SetBreaker(proxy.BreakerConfig{Failures: 1, Ejection: 50 * time.Millisecond, MaxEjected: 0.5})
+
+	p.Report("a", &proxy.NodeError{PeerID: "a", Err: errors.New("down")})
+	if state := p.State("a"); state != proxy.BreakerOpen {
+		t.Fatalf("expected a ejected, got %s", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if conn := p.Select(proxy.RoundRobinStrategy, map[peer.ID]bool{"b": true}); conn == nil || conn.PeerID != "a" {
+		t.Fatalf("expected the trial to go to a, got %v", conn)
+	}
+
+	p.Report("b", &proxy.NodeError{PeerID: "b", Err: errors.New("down")})
+	if state := p.State("b"); state != proxy.BreakerClosed {
+		t.Fatalf("expected b kept while a is on trial, got %s", state)
+	}
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A reverse tunnel publishes a service reachable from the client on a port of
+// an exit node. The client sends CommandListen on a proxy stream with the bind
+// address and a random token, and keeps that stream open as long as it wants
+// the tunnel. For every connection the node accepts, it opens a reverse stream
+// back to the client carrying the token and the address of the remote end, and
+// the client connects it to its local target.
+
+// tunnel serves a CommandListen request. The listener is closed once the
+// client closes the control stream.
+func (h *Server) tunnel(ctrl net.Conn, remotePeer peer.ID, c codec, req *Request) {
+	if req.Tunnel == "" {
+		h.sendError(ctrl, c, NewError(CodeGeneralFailure, "missing tunnel token"))
+		return
+	}
+
+	sl, err := h.admit(ctrl, c, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	_ = ctrl.SetDeadline(time.Time{})
+
+	ln, err := h.listen(req.ProxyAddress)
+	if err != nil {
+		logging.Logger.Warn("Refusing listen request", "from", remotePeer, "addr", req.ProxyAddress, "error", err)
+		h.sendError(ctrl, c, err)
+
+		return
+	}
+
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+
+	if err := c.writeResponse(ctrl, &ProxyResponse{Status: StatusOK, Address: addr}); err != nil {
+		logging.Logger.Error("Failed to send success response", "error", err)
+		return
+	}
+
+	logging.Logger.Info("Reverse tunnel opened", "from", remotePeer, "addr", addr)
+
+	go h.accept(ln, remotePeer, req.Tunnel)
+
+	_, _ = io.Copy(io.Discard, ctrl)
+
+	logging.Logger.Info("Reverse tunnel closed", "from", remotePeer, "addr", addr)
+}
+
+// listen opens a TCP listener on addr if the policy lets clients claim it. The
+// host must be an IP address; an empty host listens on all IPv4 addresses.
+func (h *Server) listen(addr string) (net.Listener, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, NewError(CodeGeneralFailure, fmt.Sprintf("invalid listen address %q", addr))
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, NewError(CodeGeneralFailure, fmt.Sprintf("invalid listen port %q", portStr))
+	}
+
+	ip := netip.IPv4Unspecified()
+	if host != "" {
+		ip, err = netip.ParseAddr(host)
+		if err != nil {
+			return nil, NewError(CodeGeneralFailure, fmt.Sprintf("listen host %q is not an IP address", host))
+		}
+	}
+
+	bind := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+
+	if !h.policy.AllowedListen(bind.Addr(), bind.Port()) {
+		return nil, NewError(CodeNotAllowed, fmt.Sprintf("listening on %s is not allowed by node policy", bind))
+	}
+
+	return net.Listen("tcp", bind.String())
+}
+
+// accept relays the connections accepted on ln until it is closed
+func (h *Server) accept(ln net.Listener, remotePeer peer.ID, token string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.Logger.Error("Failed to accept tunnel connection", "addr", ln.Addr(), "error", err)
+			}
+
+			return
+		}
+
+		go h.reverse(conn, remotePeer, token)
+	}
+}
+
+// reverse relays a connection accepted for a tunnel to the client on a new
+// reverse stream. It counts as a stream of the client for limits and usage.
+func (h *Server) reverse(conn net.Conn, remotePeer peer.ID, token string) {
+	defer conn.Close()
+
+	sl, err := h.admit(io.Discard, binaryCodec{}, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	s, err := h.host.NewStream(network.WithAllowLimitedConn(ctx, "ReverseProtocolID"), remotePeer, ReverseProtocolID)
+	if err != nil {
+		logging.Logger.Error("Failed to open reverse stream", "to", remotePeer, "error", err)
+		return
+	}
+
+	stream := &pkgnetwork.Adapter{Stream: s}
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(dialTimeout))
+
+	c := binaryCodec{}
+
+	req := &Request{Command: CommandConnect, ProxyAddress: conn.RemoteAddr().String(), Tunnel: token}
+	if err := c.writeRequest(stream, req); err != nil {
+		logging.Logger.Error("Failed to send reverse request", "to", remotePeer, "error", err)
+		return
+	}
+
+	resp, err := c.readResponse(stream)
+	if err == nil {
+		err = resp.Err()
+	}
+
+	if err != nil {
+		logging.Logger.Warn("Client refused reverse connection", "to", remotePeer, "error", err)
+		return
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	logging.Logger.Info("Relaying tunnel connection", "from", conn.RemoteAddr(), "to", remotePeer)
+
+	if err := h.forward(stream, conn, sl); err != nil {
+		logging.Logger.Error("Forwarding error", "error", err)
+	}
+}
+
+// Tunnel is a listener an exit node keeps open for the client. Connections it
+// accepts are relayed to Target.
+type Tunnel struct {
+	PeerID peer.ID
+	// Addr is the address the node listens on
+	Addr   string
+	Target string
+
+	token string
+	ctrl  network.Stream
+	done  chan struct{}
+}
+
+// Done is closed once the tunnel is gone, either closed by the client or lost
+// with the node
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close asks the node to stop listening. Connections already relayed keep
+// running.
+func (t *Tunnel) Close() error {
+	return t.ctrl.Close()
+}
+
+// Listen asks a specific exit node to listen on addr and relay every
+// connection it accepts to target, an address dialed from this machine
+func (d *Client) Listen(ctx context.Context, peerID peer.ID, addr string, target string) (*Tunnel, error) {
+	d.reverseOnce.Do(func() {
+		d.Host.SetStreamHandler(ReverseProtocolID, d.handleReverse)
+	})
+
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "ProxyProtocolID"), peerID, ProxyProtocolV2ID)
+	if err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to open stream: %w", err)}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	t := &Tunnel{PeerID: peerID, Target: target, token: rand.Text(), ctrl: stream, done: make(chan struct{})}
+
+	// The node may relay a connection as soon as it answers, so the tunnel is
+	// known before the request is sent.
+	d.register(t)
+
+	if err := d.open(t, addr); err != nil {
+		d.unregister(t)
+		_ = stream.Reset()
+
+		return nil, err
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+
+		d.unregister(t)
+		close(t.done)
+	}()
+
+	return t, nil
+}
+
+// open sends the CommandListen request of t and waits for the bound address
+func (d *Client) open(t *Tunnel, addr string) error {
+	c := binaryCodec{}
+
+	req := &Request{Command: CommandListen, ProxyAddress: addr, Tunnel: t.token}
+	if err := c.writeRequest(t.ctrl, req); err != nil {
+		return &NodeError{PeerID: t.PeerID, Err: fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	resp, err := c.readResponse(t.ctrl)
+	if err != nil {
+		return &NodeError{PeerID: t.PeerID, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if err := resp.Err(); err != nil {
+		if IsNodeError(err) {
+			return &NodeError{PeerID: t.PeerID, Err: err}
+		}
+
+		return err
+	}
+
+	t.Addr = resp.Address
+
+	return nil
+}
+
+// ListenByStrategy opens a tunnel on an exit node chosen by the pool's current
+// strategy, failing over to other nodes like DialByStrategy
+func (d *Client) ListenByStrategy(ctx context.Context, addr string, target string) (*Tunnel, error) {
+	var t *Tunnel
+
+	err := d.failover(ctx, "listen", func(c *Connection) error {
+		var err error
+		t, err = d.Listen(ctx, c.PeerID, addr, target)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// reverseTunnels tracks the open tunnels of a client by token
+type reverseTunnels struct {
+	mu      sync.Mutex
+	tunnels map[string]*Tunnel
+}
+
+func (d *Client) register(t *Tunnel) {
+	d.reverse.mu.Lock()
+	defer d.reverse.mu.Unlock()
+
+	if d.reverse.tunnels == nil {
+		d.reverse.tunnels = make(map[string]*Tunnel)
+	}
+
+	d.reverse.tunnels[t.token] = t
+}
+
+func (d *Client) unregister(t *Tunnel) {
+	d.reverse.mu.Lock()
+	defer d.reverse.mu.Unlock()
+
+	delete(d.reverse.tunnels, t.token)
+}
+
+func (d *Client) lookup(token string) *Tunnel {
+	d.reverse.mu.Lock()
+	defer d.reverse.mu.Unlock()
+
+	return d.reverse.tunnels[token]
+}
+
+// handleReverse connects a reverse stream from a node to the target of its
+// tunnel. Streams with an unknown token, or from a node other than the one
+// holding the tunnel, are reset.
+func (d *Client) handleReverse(s network.Stream) {
+	stream := pkgnetwork.NewAdapter(s, d.load(s.Conn().RemotePeer()))
+	defer stream.Close()
+
+	_ = stream.SetDeadline(time.Now().Add(dialTimeout))
+
+	c := binaryCodec{}
+
+	req, err := c.readRequest(stream)
+	if err != nil {
+		logging.Logger.Error("Failed to decode reverse request", "error", err)
+		_ = s.Reset()
+
+		return
+	}
+
+	t := d.lookup(req.Tunnel)
+	if t == nil || t.PeerID != s.Conn().RemotePeer() {
+		logging.Logger.Warn("Rejecting reverse stream for unknown tunnel", "from", s.Conn().RemotePeer())
+		_ = s.Reset()
+
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", t.Target, dialTimeout)
+	if err != nil {
+		logging.Logger.Error("Failed to connect to tunnel target", "target", t.Target, "error", err)
+
+		resp := &ProxyResponse{Status: StatusError, Code: Classify(err), Message: err.Error()}
+		if encErr := c.writeResponse(stream, resp); encErr != nil {
+			logging.Logger.Error("Failed to encode error response", "error", encErr)
+		}
+
+		return
+	}
+
+	defer conn.Close()
+
+	if err := c.writeResponse(stream, &ProxyResponse{Status: StatusOK}); err != nil {
+		logging.Logger.Error("Failed to send success response", "error", err)
+		return
+	}
+
+	_ = stream.SetDeadline(time.Time{})
+
+	logging.Logger.Info("Tunnel connection", "node", t.PeerID, "addr", t.Addr, "from", req.ProxyAddress, "target", t.Target)
+
+	if err := splice(stream, conn, stream, stream); err != nil {
+		logging.Logger.Error("Tunnel forwarding error", "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Selector matches nodes by their labels. Each entry requires the label to be
+// set; a non-empty value also requires the label to have that value.
+type Selector map[string]string
+
+// ParseSelector parses a comma separated list of key=value or bare key terms,
+// such as "region=eu,datacenter"
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector)
+
+	for term := range strings.SplitSeq(s, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(term), "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid label selector %q", s)
+		}
+
+		sel[key] = value
+	}
+
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every term of the selector. An empty
+// selector matches every node.
+func (s Selector) Matches(labels map[string]string) bool {
+	for key, want := range s {
+		got, ok := labels[key]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Selector) String() string {
+	terms := make([]string, 0, len(s))
+	for _, key := range slices.Sorted(maps.Keys(s)) {
+		if s[key] == "" {
+			terms = append(terms, key)
+		} else {
+			terms = append(terms, key+"="+s[key])
+		}
+	}
+
+	return strings.Join(terms, ",")
+}
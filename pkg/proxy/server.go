@@ -2,26 +2,89 @@ package proxy
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"strconv"
+	"time"
 
+	"github.com/henrybarreto/bethrou/pkg/limits"
 	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+	"github.com/henrybarreto/bethrou/pkg/policy"
+	"github.com/henrybarreto/bethrou/pkg/usage"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
 )
 
+// dialTimeout bounds how long the node waits for a destination to accept
+const dialTimeout = 10 * time.Second
+
+// handshakeTimeout bounds how long a client has to send its request. Streams
+// only count against the stream limits once admitted, so one stalled before
+// that must not be kept open.
+const handshakeTimeout = 10 * time.Second
+
+// ServerConfig contains the node-side settings of the proxy handler
+type ServerConfig struct {
+	// Policy decides which destinations the node may reach. When nil,
+	// policy.Default is used.
+	Policy *policy.Policy
+	// Limits shapes bandwidth and caps concurrent streams per peer and for the
+	// whole node. When nil, streams are not limited.
+	Limits *limits.Limiter
+	// Usage accounts traffic per peer and enforces monthly quotas. When nil,
+	// usage is only kept in memory.
+	Usage *usage.Ledger
+	// NoForward refuses CommandForward requests, so the node is never a
+	// middle hop of a circuit. It can still be the last one.
+	NoForward bool
+}
+
 // Server handles incoming proxy requests from clients
 type Server struct {
-	host host.Host
+	host      host.Host
+	policy    *policy.Policy
+	limits    *limits.Limiter
+	usage     *usage.Ledger
+	noForward bool
+	noise     *noise.Transport
 }
 
 // NewServer creates a new proxy handler for the server (node) side
-func NewServer(h host.Host) *Server {
-	s := &Server{host: h}
-	s.host.SetStreamHandler(ProxyProtocolID, s.handle)
+func NewServer(h host.Host, cfg ServerConfig) *Server {
+	s := &Server{host: h, policy: cfg.Policy, limits: cfg.Limits, usage: cfg.Usage, noForward: cfg.NoForward}
+	if s.policy == nil {
+		s.policy = policy.Default()
+	}
+
+	if s.limits == nil {
+		s.limits = limits.Unlimited()
+	}
+
+	if s.usage == nil {
+		s.usage = usage.InMemory()
+	}
+
+	for _, id := range ProxyProtocols {
+		s.host.SetStreamHandler(id, s.handle)
+	}
+	s.host.SetStreamHandler(UDPProtocolID, s.handleUDP)
+	s.host.SetStreamHandler(DNSProtocolID, s.handleDNS)
+
+	tpt, err := noise.New(noise.ID, h.Peerstore().PrivKey(h.ID()), nil)
+	if err != nil {
+		logging.Logger.Error("Failed to set up hop encryption; circuits cannot end here", "error", err)
+	} else {
+		s.noise = tpt
+		s.host.SetStreamHandler(HopProtocolID, s.handleHop)
+	}
+
 	s.host.SetStreamHandler(PingProtocolID, func(s network.Stream) {
 		_ = s.Close()
 	})
@@ -35,84 +98,313 @@ func (h *Server) handle(s network.Stream) {
 
 	remotePeer := s.Conn().RemotePeer()
 
-	logging.Logger.Info("New proxy stream", "from", remotePeer)
+	logging.Logger.Info("New proxy stream", "from", remotePeer, "protocol", s.Protocol())
 
-	var req Request
-	if err := json.NewDecoder(s).Decode(&req); err != nil {
+	h.serve(&pkgnetwork.Adapter{Stream: s}, remotePeer, codecFor(s.Protocol()), true)
+}
+
+// serve reads a proxy request from the client side of a stream and connects
+// it to the destination or, for CommandForward, to the next node of a circuit.
+// Direct is false for streams that arrive through a circuit, whose client
+// cannot be reached back for reverse tunnels.
+func (h *Server) serve(client net.Conn, remotePeer peer.ID, c codec, direct bool) {
+	_ = client.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	req, err := c.readRequest(client)
+	if err != nil {
 		if err == io.EOF {
 			logging.Logger.Warn("Empty proxy request", "from", remotePeer)
 		}
 
 		logging.Logger.Error("Failed to decode proxy request", "error", err)
-		h.sendError(s, err)
+		h.sendError(client, c, err)
 
 		return
 	}
 
-	logging.Logger.Info("Proxying to", "addr", req.ProxyAddress)
+	target := req.ProxyAddress
+
+	switch req.Command {
+	case CommandConnect:
+	case CommandForward:
+		target = req.Peer
+
+		if h.noForward {
+			logging.Logger.Warn("Refusing forward request", "from", remotePeer, "peer", req.Peer)
+			h.sendError(client, c, NewError(CodeNotAllowed, "node does not forward circuits"))
+
+			return
+		}
+	case CommandListen:
+		if !direct {
+			h.sendError(client, c, NewError(CodeNotAllowed, "reverse tunnels cannot go through a circuit"))
+			return
+		}
+
+		h.tunnel(client, remotePeer, c, req)
+
+		return
+	case CommandBind:
+		h.bind(client, remotePeer, c, req)
+
+		return
+	default:
+		logging.Logger.Warn("Unsupported proxy command", "from", remotePeer, "command", req.Command)
+		h.sendError(client, c, NewError(CodeGeneralFailure, fmt.Sprintf("unsupported command %d", req.Command)))
+
+		return
+	}
+
+	sl, err := h.admit(client, c, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	_ = client.SetDeadline(time.Time{})
+
+	var conn net.Conn
+	if req.Command == CommandForward {
+		logging.Logger.Info("Forwarding to peer", "peer", target)
+
+		conn, err = h.dialHop(context.Background(), req.Peer, req.PeerAddrs)
+	} else {
+		logging.Logger.Info("Proxying to", "addr", target)
+
+		conn, err = h.dial(context.Background(), target)
+	}
 
-	conn, err := net.Dial("tcp", req.ProxyAddress)
 	if err != nil {
-		logging.Logger.Error("Failed to connect to proxy address", "addr", req.ProxyAddress, "error", err)
-		h.sendError(s, err)
+		logging.Logger.Error("Failed to connect to proxy address", "addr", target, "error", err)
+		h.sendError(client, c, err)
 		return
 	}
 
 	defer conn.Close()
 
-	if err := h.sendSuccess(s); err != nil {
+	if err := h.sendSuccess(client, c); err != nil {
 		logging.Logger.Error("Failed to send success response", "error", err)
 		return
 	}
 
-	logging.Logger.Info("Starting data forwarding", "addr", req.ProxyAddress)
+	logging.Logger.Info("Starting data forwarding", "addr", target)
 
-	if err := h.forward(s, conn); err != nil {
+	if err := h.forward(client, conn, sl); err != nil {
 		logging.Logger.Error("Forwarding error", "error", err)
 	}
 
-	logging.Logger.Info("Proxy stream completed", "addr", req.ProxyAddress)
+	logging.Logger.Info("Proxy stream completed", "addr", target)
+}
+
+// slot is a stream admitted by the limits and accounted in the usage ledger
+type slot struct {
+	lease   *limits.Lease
+	session *usage.Session
+}
+
+// reader shapes and counts data the client sends on the stream
+func (sl *slot) reader(r io.Reader) io.Reader {
+	return sl.session.Reader(sl.lease.Reader(r))
+}
+
+// writer shapes and counts data sent back to the client on the stream
+func (sl *slot) writer(w io.Writer) io.Writer {
+	return sl.lease.Writer(sl.session.Writer(w))
+}
+
+func (sl *slot) release() {
+	sl.session.End()
+	sl.lease.Release()
+}
+
+// admit takes a stream slot for the remote peer. A peer over its monthly quota
+// is told so with CodeQuotaExceeded and a peer or node at its stream limit
+// with CodeOverloaded. Streams admitted under the quota are cut once the peer
+// uses it up.
+func (h *Server) admit(w io.Writer, c codec, remotePeer peer.ID) (*slot, error) {
+	quota := h.limits.Quota(remotePeer)
+	if quota > 0 {
+		if used := h.usage.Month(remotePeer); used >= uint64(quota) {
+			err := NewError(CodeQuotaExceeded, fmt.Sprintf("monthly quota of %d bytes used", quota))
+
+			logging.Logger.Warn("Rejecting stream over quota", "from", remotePeer, "used", used, "quota", quota)
+			h.sendError(w, c, err)
+
+			return nil, err
+		}
+	}
+
+	lease, err := h.limits.Acquire(remotePeer)
+	if err != nil {
+		logging.Logger.Warn("Rejecting stream over limit", "from", remotePeer, "error", err)
+		h.sendError(w, c, NewError(CodeOverloaded, err.Error()))
+
+		return nil, err
+	}
+
+	return &slot{lease: lease, session: h.usage.Begin(remotePeer, uint64(quota))}, nil
 }
 
-// sendError sends an error response to the client
-func (h *Server) sendError(s network.Stream, err error) {
-	resp := ProxyResponse{
-		Status:  "error",
+// resolve turns a host:port into the addresses the policy lets the node reach.
+// Domain names are resolved here so the checked address is the one dialed.
+func (h *Server) resolve(ctx context.Context, addr string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	var domain string
+	var ips []netip.Addr
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		domain = host
+
+		ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	allowed := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if h.policy.Allowed(policy.Destination{Domain: domain, IP: ip, Port: uint16(port)}) {
+			allowed = append(allowed, netip.AddrPortFrom(ip, uint16(port)))
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, NewError(CodeNotAllowed, fmt.Sprintf("%s is not allowed by node policy", addr))
+	}
+
+	return allowed, nil
+}
+
+// dial connects to addr through the first reachable address allowed by policy
+func (h *Server) dial(ctx context.Context, addr string) (net.Conn, error) {
+	addrs, err := h.resolve(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d := net.Dialer{Timeout: dialTimeout}
+
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := d.DialContext(ctx, "tcp", a.String())
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// sendError sends an error response to the client, classified by Classify
+func (h *Server) sendError(w io.Writer, c codec, err error) {
+	resp := &ProxyResponse{
+		Status:  StatusError,
+		Code:    Classify(err),
 		Message: err.Error(),
 	}
-	if encErr := json.NewEncoder(s).Encode(resp); encErr != nil {
+
+	var perr *Error
+	if errors.As(err, &perr) {
+		resp.Message = perr.Message
+	}
+
+	if encErr := c.writeResponse(w, resp); encErr != nil {
 		logging.Logger.Error("Failed to encode error response", "error", encErr)
 	}
 }
 
 // sendSuccess sends a success response to the client
-func (h *Server) sendSuccess(s network.Stream) error {
-	resp := ProxyResponse{Status: "ok"}
-	return json.NewEncoder(s).Encode(resp)
+func (h *Server) sendSuccess(w io.Writer, c codec) error {
+	return c.writeResponse(w, &ProxyResponse{Status: StatusOK})
+}
+
+// forward bidirectionally forwards data between the client side and the
+// outbound connection. Traffic goes through the stream slot.
+func (h *Server) forward(client net.Conn, conn net.Conn, sl *slot) error {
+	return splice(client, conn, sl.reader(client), sl.writer(client))
 }
 
-// forward bidirectionally forwards data between the stream and the TCP connection
-func (h *Server) forward(s network.Stream, conn net.Conn) error {
+// splice copies data between a and b, reading from a through ar and writing to
+// it through aw. EOF in one direction is passed on as a half-close of the other
+// side, and splicing only ends once both directions are done. An error in
+// either direction aborts both.
+func splice(a, b net.Conn, ar io.Reader, aw io.Writer) error {
 	errCh := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(conn, s)
+		_, err := io.Copy(b, ar)
+		if err == nil {
+			err = closeWrite(b)
+		}
+
 		errCh <- err
 	}()
 
 	go func() {
-		_, err := io.Copy(s, conn)
+		_, err := io.Copy(aw, b)
+		if err == nil {
+			err = closeWrite(a)
+		}
+
 		errCh <- err
 	}()
 
-	err := <-errCh
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("forwarding failed: %w", err)
+	var first error
+	for range 2 {
+		if err := <-errCh; err != nil && first == nil {
+			first = err
+
+			abort(a)
+			_ = b.Close()
+		}
+	}
+
+	if first != nil {
+		return fmt.Errorf("forwarding failed: %w", first)
+	}
+
+	return nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the write side of conn when it supports half-close
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
 	}
 
 	return nil
 }
 
+// abort tears down c, resetting it when it is a stream so the other end sees
+// an error rather than a clean close
+func abort(c net.Conn) {
+	if r, ok := c.(interface{ Reset() error }); ok {
+		_ = r.Reset()
+		return
+	}
+
+	_ = c.Close()
+}
+
 func (s *Server) Listen(ctx context.Context) {
 	logging.Logger.Info("Server is listening for incoming proxy streams")
 
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// statsWindow is how many recent probes the success ratio and p95 cover
+	statsWindow = 20
+	// statsAlpha is the weight of a new sample in the moving averages
+	statsAlpha = 0.3
+)
+
+// Stats summarizes the recent health probes of a node
+type Stats struct {
+	// EWMA is the moving average of the round trips of successful probes
+	EWMA time.Duration
+	// Jitter is the moving average of the change between consecutive round
+	// trips
+	Jitter time.Duration
+	// P95 is the 95th percentile round trip over the window
+	P95 time.Duration
+	// Success is the share of probes in the window that succeeded
+	Success float64
+	// Probes is how many probes the window holds
+	Probes int
+	// Failed reports whether the last probe failed
+	Failed bool
+}
+
+// Score ranks nodes for the fastest strategy; lower is better. It is the
+// worse of the average round trip padded by twice the jitter and the p95,
+// divided by the success ratio, so slow, erratic and lossy nodes all rank
+// down. Nodes without a successful probe, or whose last probe failed, score
+// +Inf.
+func (s Stats) Score() float64 {
+	if s.Failed || s.Success == 0 {
+		return math.Inf(1)
+	}
+
+	rtt := max(s.EWMA+2*s.Jitter, s.P95)
+
+	return float64(rtt) / s.Success
+}
+
+// probe is one health probe result
+type probe struct {
+	rtt time.Duration
+	ok  bool
+}
+
+// stats keeps the probes of a node in a ring of statsWindow entries
+type stats struct {
+	window [statsWindow]probe
+	n      int
+	next   int
+
+	ewma   float64
+	jitter float64
+	last   time.Duration
+	seen   bool
+	failed bool
+}
+
+// record adds a probe result
+func (s *stats) record(rtt time.Duration, ok bool) {
+	s.window[s.next] = probe{rtt: rtt, ok: ok}
+	s.next = (s.next + 1) % statsWindow
+	s.n = min(s.n+1, statsWindow)
+	s.failed = !ok
+
+	if !ok {
+		return
+	}
+
+	if !s.seen {
+		s.ewma, s.last, s.seen = float64(rtt), rtt, true
+		return
+	}
+
+	delta := math.Abs(float64(rtt - s.last))
+	s.jitter += statsAlpha * (delta - s.jitter)
+	s.ewma += statsAlpha * (float64(rtt) - s.ewma)
+	s.last = rtt
+}
+
+// summary computes the Stats of the window
+func (s *stats) summary() Stats {
+	st := Stats{
+		EWMA:   time.Duration(s.ewma),
+		Jitter: time.Duration(s.jitter),
+		Probes: s.n,
+		Failed: s.failed,
+	}
+
+	rtts := make([]time.Duration, 0, s.n)
+	for _, p := range s.window[:s.n] {
+		if p.ok {
+			rtts = append(rtts, p.rtt)
+		}
+	}
+
+	if s.n > 0 {
+		st.Success = float64(len(rtts)) / float64(s.n)
+	}
+
+	if len(rtts) > 0 {
+		slices.Sort(rtts)
+		st.P95 = rtts[int(math.Ceil(0.95*float64(len(rtts))))-1]
+	}
+
+	return st
+}
+
+// Record adds the result of a health probe of peerID to its statistics and
+// feeds it to its circuit breaker. A non-nil err marks the probe as failed.
+func (p *Pool) Record(peerID peer.ID, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		if conn.PeerID == peerID {
+			conn.stats.record(rtt, err == nil)
+			conn.Latency = time.Duration(conn.stats.ewma)
+			p.report(peerID, err == nil)
+
+			return
+		}
+	}
+}
+
+// Stats returns the probe statistics of peerID
+func (p *Pool) Stats(peerID peer.ID) Stats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, conn := range p.conns {
+		if conn.PeerID == peerID {
+			return conn.stats.summary()
+		}
+	}
+
+	return Stats{}
+}
+
+// Probe pings every node in the pool at once, each bounded by timeout, and
+// records the results
+func (d *Client) Probe(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, c := range d.Pool.All() {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			rtt, err := d.Ping(ctx, c)
+			d.Pool.Record(c.PeerID, rtt, err)
+
+			if err != nil {
+				logging.Logger.Warn("Health check failed", "peer", c.PeerID, "error", err)
+				return
+			}
+
+			st := d.Pool.Stats(c.PeerID)
+			logging.Logger.Debug("Node healthy", "peer", c.PeerID, "rtt", rtt, "ewma", st.EWMA, "jitter", st.Jitter, "p95", st.P95, "success", st.Success)
+		}()
+	}
+
+	wg.Wait()
+}
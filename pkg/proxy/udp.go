@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/henrybarreto/bethrou/pkg/logging"
+	pkgnetwork "github.com/henrybarreto/bethrou/pkg/network"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// handleUDP relays datagrams for one UDP association. The node owns a UDP
+// socket for as long as the stream stays open; every datagram on the stream is
+// framed with its destination (client to node) or source (node to client).
+func (h *Server) handleUDP(s network.Stream) {
+	defer s.Close()
+
+	remotePeer := s.Conn().RemotePeer()
+	c := binaryCodec{}
+
+	logging.Logger.Info("New UDP association", "from", remotePeer)
+
+	sl, err := h.admit(s, c, remotePeer)
+	if err != nil {
+		return
+	}
+
+	defer sl.release()
+
+	up, down := sl.reader(s), sl.writer(s)
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logging.Logger.Error("Failed to open UDP socket", "error", err)
+		h.sendError(s, c, err)
+
+		return
+	}
+
+	defer pc.Close()
+
+	if err := h.sendSuccess(s, c); err != nil {
+		logging.Logger.Error("Failed to send success response", "error", err)
+		return
+	}
+
+	go func() {
+		buf := make([]byte, pkgnetwork.MaxDatagramSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logging.Logger.Error("Failed to read from UDP socket", "error", err)
+					_ = s.Reset()
+				}
+
+				return
+			}
+
+			if err := pkgnetwork.WriteDatagram(down, from.String(), buf[:n]); err != nil {
+				logging.Logger.Debug("Failed to relay datagram to client", "error", err)
+
+				return
+			}
+		}
+	}()
+
+	resolved := newUDPDestinations()
+	buf := make([]byte, pkgnetwork.MaxDatagramSize)
+	for {
+		addr, n, err := pkgnetwork.ReadDatagram(up, buf)
+		if err != nil {
+			if err != io.EOF {
+				logging.Logger.Debug("UDP association read failed", "error", err)
+			}
+
+			break
+		}
+
+		dst := resolved.get(addr, time.Now())
+		if dst == nil {
+			addrs, err := h.resolve(context.Background(), addr)
+			if err != nil {
+				logging.Logger.Warn("Dropping datagram", "addr", addr, "error", err)
+				continue
+			}
+
+			dst = net.UDPAddrFromAddrPort(addrs[0])
+			resolved.put(addr, dst, time.Now())
+		}
+
+		if _, err := pc.WriteTo(buf[:n], dst); err != nil {
+			logging.Logger.Debug("Failed to send datagram", "addr", addr, "error", err)
+		}
+	}
+
+	logging.Logger.Info("UDP association completed", "from", remotePeer)
+}
+
+const (
+	// udpResolveTTL is how long an association reuses a resolved destination
+	// before resolving it and checking it against the policy again
+	udpResolveTTL = time.Minute
+	// udpResolveMax bounds the destinations an association keeps resolved
+	udpResolveMax = 256
+)
+
+// udpDestinations caches the resolved destinations of one UDP association.
+// Failed lookups are not cached, so a denied destination is checked again on
+// its next datagram.
+type udpDestinations struct {
+	entries map[string]udpDestination
+}
+
+type udpDestination struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+func newUDPDestinations() *udpDestinations {
+	return &udpDestinations{entries: make(map[string]udpDestination)}
+}
+
+// get returns the destination resolved for addr, or nil when there is none
+// or it has expired
+func (u *udpDestinations) get(addr string, now time.Time) *net.UDPAddr {
+	e, ok := u.entries[addr]
+	if !ok {
+		return nil
+	}
+
+	if !now.Before(e.expires) {
+		delete(u.entries, addr)
+		return nil
+	}
+
+	return e.addr
+}
+
+// put caches dst for addr. When the cache is full, expired entries are
+// dropped first and then the entry closest to expiring.
+func (u *udpDestinations) put(addr string, dst *net.UDPAddr, now time.Time) {
+	if _, ok := u.entries[addr]; !ok && len(u.entries) >= udpResolveMax {
+		oldest := ""
+		for k, e := range u.entries {
+			if !now.Before(e.expires) {
+				delete(u.entries, k)
+			} else if oldest == "" || e.expires.Before(u.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+
+		if len(u.entries) >= udpResolveMax {
+			delete(u.entries, oldest)
+		}
+	}
+
+	u.entries[addr] = udpDestination{addr: dst, expires: now.Add(udpResolveTTL)}
+}
+
+// ListenPacket opens a UDP association through a specific exit node. Datagrams
+// written to the returned connection are sent from the node's address.
+func (d *Client) ListenPacket(ctx context.Context, peerID peer.ID) (net.PacketConn, error) {
+	stream, err := d.Host.NewStream(network.WithAllowLimitedConn(ctx, "UDPProtocolID"), peerID, UDPProtocolID)
+	if err != nil {
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to open stream: %w", err)}
+	}
+
+	resp, err := binaryCodec{}.readResponse(stream)
+	if err != nil {
+		_ = stream.Close()
+		return nil, &NodeError{PeerID: peerID, Err: fmt.Errorf("failed to read response: %w", err)}
+	}
+
+	if err := resp.Err(); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	return &pkgnetwork.PacketAdapter{Stream: stream}, nil
+}
+
+// ListenPacketByStrategy opens a UDP association through an exit node chosen
+// by the pool's current strategy, failing over to other nodes like
+// DialByStrategy.
+func (d *Client) ListenPacketByStrategy(ctx context.Context) (net.PacketConn, error) {
+	return d.ListenPacketRoute(ctx, Route{})
+}
+
+// ListenPacketRoute opens a UDP association through an exit node picked for
+// route, failing over to other nodes like DialRoute
+func (d *Client) ListenPacketRoute(ctx context.Context, route Route) (net.PacketConn, error) {
+	var pc net.PacketConn
+
+	err := d.failoverRoute(ctx, "listen packet", route, func(c *Connection) error {
+		var err error
+		pc, err = d.ListenPacket(ctx, c.PeerID)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
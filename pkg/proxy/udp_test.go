@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPDestinations_Expire(t *testing.T) {
+	u := newUDPDestinations()
+	now := time.Now()
+	dst := &net.UDPAddr{IP: net.IPv4(93, 184, 216, 34), Port: 53}
+
+	u.put("example.com:53", dst, now)
+
+	if got := u.get("example.com:53", now.Add(udpResolveTTL-time.Second)); got != dst {
+		t.Fatalf("expected cached destination, got %v", got)
+	}
+
+	if got := u.get("example.com:53", now.Add(udpResolveTTL)); got != nil {
+		t.Fatalf("expected expired destination to be resolved again, got %v", got)
+	}
+
+	if len(u.entries) != 0 {
+		t.Fatalf("expected expired entry to be dropped, have %d", len(u.entries))
+	}
+}
+
+func TestUDPDestinations_Bounded(t *testing.T) {
+	u := newUDPDestinations()
+	now := time.Now()
+
+	for i := range udpResolveMax + 10 {
+		u.put(fmt.Sprintf("host%d:53", i), &net.UDPAddr{Port: 53}, now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	if len(u.entries) != udpResolveMax {
+		t.Fatalf("expected %d entries, have %d", udpResolveMax, len(u.entries))
+	}
+
+	if u.get("host0:53", now) != nil {
+		t.Fatal("expected the oldest entry to be evicted")
+	}
+
+	if u.get(fmt.Sprintf("host%d:53", udpResolveMax+9), now) == nil {
+		t.Fatal("expected the newest entry to be kept")
+	}
+}
@@ -0,0 +1,435 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// reportThreshold is how many bytes a session counts before adding them to
+// the ledger. Smaller amounts wait for the next Flush, Month or Report, or for
+// the end of the stream.
+const reportThreshold = 256 * 1024
+
+// ErrQuotaExceeded is returned by the readers and writers of a session once its
+// peer has used up its monthly quota
+var ErrQuotaExceeded = errors.New("monthly quota exceeded")
+
+// dailyRetention is how many days of daily totals are kept in the ledger.
+// Monthly and all-time totals are kept forever.
+const dailyRetention = 92 * 24 * time.Hour
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Period selects a roll-up of the ledger
+type Period string
+
+const (
+	Daily   Period = "daily"
+	Monthly Period = "monthly"
+	AllTime Period = "all"
+)
+
+// Totals is the traffic of one peer over a period. BytesIn is data received
+// from the client and BytesOut the data sent back to it. Duration is the time
+// streams ending in the period were open.
+type Totals struct {
+	BytesIn  uint64        `json:"bytes_in"`
+	BytesOut uint64        `json:"bytes_out"`
+	Streams  uint64        `json:"streams"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+func (t *Totals) add(d Totals) {
+	t.BytesIn += d.BytesIn
+	t.BytesOut += d.BytesOut
+	t.Streams += d.Streams
+	t.Duration += d.Duration
+}
+
+// Record holds the roll-ups of one peer, keyed by UTC day and month
+type Record struct {
+	Daily   map[string]*Totals `json:"daily"`
+	Monthly map[string]*Totals `json:"monthly"`
+	AllTime Totals             `json:"all_time"`
+}
+
+// add adds d to the roll-ups at time t and returns the totals of its month
+func (r *Record) add(t time.Time, d Totals) *Totals {
+	day := bucket(r.Daily, t.Format(dayLayout))
+	day.add(d)
+
+	month := bucket(r.Monthly, t.Format(monthLayout))
+	month.add(d)
+
+	r.AllTime.add(d)
+
+	return month
+}
+
+func bucket(m map[string]*Totals, key string) *Totals {
+	t, ok := m[key]
+	if !ok {
+		t = &Totals{}
+		m[key] = t
+	}
+
+	return t
+}
+
+// snapshot is the on-disk ledger format
+type snapshot struct {
+	Peers map[string]*Record `json:"peers"`
+}
+
+// Ledger accounts traffic per remote peer. It is safe for concurrent use.
+// When backed by a file, totals are written to it on Flush by replacing the
+// file, so it can be read while the node is running.
+type Ledger struct {
+	path string
+
+	mu       sync.Mutex
+	peers    map[string]*Record
+	sessions map[*Session]struct{}
+	dirty    bool
+}
+
+// InMemory returns a ledger that is never persisted
+func InMemory() *Ledger {
+	return &Ledger{peers: make(map[string]*Record), sessions: make(map[*Session]struct{})}
+}
+
+// Open loads the ledger stored at path. A missing file starts an empty ledger.
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{path: path, peers: make(map[string]*Record), sessions: make(map[*Session]struct{})}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage ledger: %w", err)
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse usage ledger: %w", err)
+	}
+
+	for id, r := range snap.Peers {
+		if r.Daily == nil {
+			r.Daily = make(map[string]*Totals)
+		}
+
+		if r.Monthly == nil {
+			r.Monthly = make(map[string]*Totals)
+		}
+
+		l.peers[id] = r
+	}
+
+	return l, nil
+}
+
+// Flush writes the ledger to its file if anything changed since the last
+// flush, including bytes open streams have not reported yet. Daily totals older
+// than the retention period are dropped.
+func (l *Ledger) Flush() error {
+	if l.path == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	l.collect()
+
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+
+	cutoff := time.Now().UTC().Add(-dailyRetention).Format(dayLayout)
+	for _, r := range l.peers {
+		for day := range r.Daily {
+			if day < cutoff {
+				delete(r.Daily, day)
+			}
+		}
+	}
+
+	data, err := json.Marshal(snapshot{Peers: l.peers})
+	l.dirty = false
+	l.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode usage ledger: %w", err)
+	}
+
+	if err := writeFile(l.path, data); err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// writeFile replaces path with data through a temporary file, so readers never
+// see a partial ledger
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace usage ledger: %w", err)
+	}
+
+	return nil
+}
+
+// record adds d to the totals of p at time t and returns the bytes p moved in
+// that month. The caller must hold l.mu.
+func (l *Ledger) record(p string, t time.Time, d Totals) uint64 {
+	r, ok := l.peers[p]
+	if !ok {
+		r = &Record{Daily: make(map[string]*Totals), Monthly: make(map[string]*Totals)}
+		l.peers[p] = r
+	}
+
+	month := r.add(t.UTC(), d)
+	l.dirty = true
+
+	return month.BytesIn + month.BytesOut
+}
+
+// collect adds the bytes counted by open sessions to the ledger. The caller
+// must hold l.mu.
+func (l *Ledger) collect() {
+	now := time.Now()
+	for s := range l.sessions {
+		s.report(now)
+	}
+}
+
+// Month returns the bytes p sent and received in the current UTC month
+func (l *Ledger) Month(p peer.ID) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.collect()
+
+	r, ok := l.peers[p.String()]
+	if !ok {
+		return 0
+	}
+
+	t, ok := r.Monthly[time.Now().UTC().Format(monthLayout)]
+	if !ok {
+		return 0
+	}
+
+	return t.BytesIn + t.BytesOut
+}
+
+// Row is one line of a usage report
+type Row struct {
+	Peer   string `json:"peer"`
+	Period string `json:"period"`
+	Totals
+}
+
+// Report returns the totals of every peer for a roll-up, ordered by peer and
+// period.
+func (l *Ledger) Report(period Period) ([]Row, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.collect()
+
+	var rows []Row
+	for id, r := range l.peers {
+		switch period {
+		case Daily:
+			for key, t := range r.Daily {
+				rows = append(rows, Row{Peer: id, Period: key, Totals: *t})
+			}
+		case Monthly:
+			for key, t := range r.Monthly {
+				rows = append(rows, Row{Peer: id, Period: key, Totals: *t})
+			}
+		case AllTime:
+			rows = append(rows, Row{Peer: id, Period: string(AllTime), Totals: r.AllTime})
+		default:
+			return nil, fmt.Errorf("unknown period %q", period)
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Peer != rows[j].Peer {
+			return rows[i].Peer < rows[j].Peer
+		}
+
+		return rows[i].Period < rows[j].Period
+	})
+
+	return rows, nil
+}
+
+// Begin starts accounting one stream of p. When quota is not zero, the
+// session's readers and writers fail with ErrQuotaExceeded once p has moved
+// that many bytes this month.
+func (l *Ledger) Begin(p peer.ID, quota uint64) *Session {
+	s := &Session{l: l, peer: p.String(), start: time.Now(), quota: quota}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.month.Store(l.record(s.peer, s.start, Totals{Streams: 1}))
+	l.sessions[s] = struct{}{}
+
+	return s
+}
+
+// Session accounts the traffic of one stream. Bytes are counted per session
+// and added to the ledger every reportThreshold bytes, so long-lived streams
+// show up before they end without taking the ledger lock on every read and
+// write.
+type Session struct {
+	l     *Ledger
+	peer  string
+	start time.Time
+	quota uint64
+	once  sync.Once
+
+	// in and out are the bytes not yet added to the ledger
+	in  atomic.Uint64
+	out atomic.Uint64
+	// month is the peer's monthly total as of the last report
+	month atomic.Uint64
+}
+
+// End adds the remaining bytes and the stream duration to the ledger. It is
+// safe to call more than once.
+func (s *Session) End() {
+	s.once.Do(func() {
+		s.l.mu.Lock()
+		defer s.l.mu.Unlock()
+
+		delete(s.l.sessions, s)
+
+		now := time.Now()
+		s.report(now)
+		s.l.record(s.peer, now, Totals{Duration: now.Sub(s.start)})
+	})
+}
+
+// report moves the counted bytes into the ledger at time t. The caller must
+// hold s.l.mu.
+func (s *Session) report(t time.Time) {
+	d := Totals{BytesIn: s.in.Swap(0), BytesOut: s.out.Swap(0)}
+	if d.BytesIn == 0 && d.BytesOut == 0 {
+		return
+	}
+
+	s.month.Store(s.l.record(s.peer, t, d))
+}
+
+// exceeded reports whether the peer is at its monthly quota, counting the bytes
+// of this session that have not been reported yet. Bytes of the peer's other
+// streams are seen as they report.
+func (s *Session) exceeded() bool {
+	return s.quota > 0 && s.month.Load()+s.in.Load()+s.out.Load() >= s.quota
+}
+
+// count adds n bytes to c and reports them once the session has counted
+// enough to be worth the ledger lock
+func (s *Session) count(c *atomic.Uint64, n int) {
+	c.Add(uint64(n))
+
+	if s.in.Load()+s.out.Load() < reportThreshold {
+		return
+	}
+
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+
+	s.report(time.Now())
+}
+
+// Reader counts data read from r, the client side of the stream, as bytes in
+func (s *Session) Reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, s: s}
+}
+
+// Writer counts data written to w, the client side of the stream, as bytes out
+func (s *Session) Writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, s: s}
+}
+
+type countingReader struct {
+	r io.Reader
+	s *Session
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.s.exceeded() {
+		return 0, ErrQuotaExceeded
+	}
+
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.s.count(&c.s.in, n)
+	}
+
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	s *Session
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.s.exceeded() {
+		return 0, ErrQuotaExceeded
+	}
+
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.s.count(&c.s.out, n)
+	}
+
+	return n, err
+}
@@ -0,0 +1,142 @@
+package usage_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henrybarreto/bethrou/pkg/usage"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLedger_PersistsTotals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	l, err := usage.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	p, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("failed to decode peer ID: %v", err)
+	}
+
+	s := l.Begin(p, 0)
+	if _, err := io.Copy(io.Discard, s.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := s.Writer(&out).Write([]byte("world!")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	s.End()
+	s.End()
+
+	if got := l.Month(p); got != 11 {
+		t.Fatalf("expected 11 bytes this month, got %d", got)
+	}
+
+	if err := l.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	reopened, err := usage.Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+
+	for _, period := range []usage.Period{usage.Daily, usage.Monthly, usage.AllTime} {
+		rows, err := reopened.Report(period)
+		if err != nil {
+			t.Fatalf("Report(%s) failed: %v", period, err)
+		}
+
+		if len(rows) != 1 {
+			t.Fatalf("expected one %s row, got %d", period, len(rows))
+		}
+
+		r := rows[0]
+		if r.Peer != p.String() || r.BytesIn != 5 || r.BytesOut != 6 || r.Streams != 1 {
+			t.Fatalf("unexpected %s row: %+v", period, r)
+		}
+	}
+
+	if _, err := reopened.Report("weekly"); err == nil {
+		t.Fatal("expected error for unknown period")
+	}
+}
+
+func TestLedger_CountsOpenStreams(t *testing.T) {
+	l := usage.InMemory()
+
+	p, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("failed to decode peer ID: %v", err)
+	}
+
+	s := l.Begin(p, 0)
+	defer s.End()
+
+	if _, err := io.Copy(io.Discard, s.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if got := l.Month(p); got != 5 {
+		t.Fatalf("expected 5 bytes of the open stream this month, got %d", got)
+	}
+
+	big := bytes.Repeat([]byte{'x'}, 1<<20)
+	if _, err := s.Writer(io.Discard).Write(big); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	rows, err := l.Report(usage.AllTime)
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+
+	if len(rows) != 1 || rows[0].BytesOut != 1<<20 || rows[0].Streams != 1 {
+		t.Fatalf("unexpected row: %+v", rows)
+	}
+}
+
+func TestSession_EndsOverQuota(t *testing.T) {
+	l := usage.InMemory()
+
+	p, err := peer.Decode("12D3KooWEyoppNCUx8Yx66oV9fJnriXwCcXwDDUA2kj6vnc6iDEp")
+	if err != nil {
+		t.Fatalf("failed to decode peer ID: %v", err)
+	}
+
+	s := l.Begin(p, 10)
+	defer s.End()
+
+	if _, err := io.Copy(io.Discard, s.Reader(strings.NewReader("hello"))); err != nil {
+		t.Fatalf("read under quota failed: %v", err)
+	}
+
+	if _, err := s.Writer(io.Discard).Write([]byte("world!")); err != nil {
+		t.Fatalf("write under quota failed: %v", err)
+	}
+
+	if _, err := s.Reader(strings.NewReader("more")).Read(make([]byte, 4)); !errors.Is(err, usage.ErrQuotaExceeded) {
+		t.Fatalf("expected read over quota to fail, got %v", err)
+	}
+
+	if got := l.Month(p); got != 11 {
+		t.Fatalf("expected 11 bytes this month, got %d", got)
+	}
+
+	other := l.Begin(p, 10)
+	defer other.End()
+
+	if _, err := other.Writer(io.Discard).Write([]byte("x")); !errors.Is(err, usage.ErrQuotaExceeded) {
+		t.Fatalf("expected new stream over quota to fail, got %v", err)
+	}
+}